@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/server"
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// command runs the command in the arguments after the flags, e.g. "zone export".
+func command(args []string) error {
+	switch args[0] {
+	case "zone":
+		return zoneCommand(args[1:])
+	case "pause", "resume":
+		return pauseCommand(args[0], args[1:])
+	}
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+func zoneCommand(args []string) error {
+	f := flag.NewFlagSet("zone", flag.ContinueOnError)
+	output := f.String("o", "", "export: the output file (default: stdout)")
+	plan := f.Bool("plan", false, "import: print the plan instead of the records")
+	apply := f.Bool("apply", false, "import: apply the plan and append the records to the config")
+	prune := f.Bool("prune", false, "import: delete the records which are not in the file")
+	f.Usage = func() {
+		fmt.Fprintln(f.Output(), "Usage:")
+		fmt.Fprintln(f.Output(), "  zone export [-o file]")
+		fmt.Fprintln(f.Output(), "  zone import [-plan] [-apply] [-prune] [file]")
+		f.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		f.Usage()
+		return flag.ErrHelp
+	}
+
+	name := args[0]
+	if err := f.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch name {
+	case "export":
+		w := os.Stdout
+		if *output != "" {
+			file, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+		return server.ExportZone(appCtx, w)
+	case "import":
+		r := os.Stdin
+		if filename := f.Arg(0); filename != "" && filename != "-" {
+			file, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		rules, p, err := server.ImportZone(appCtx, data, *prune)
+		if err != nil {
+			return err
+		}
+
+		if *apply {
+			_, err := server.ApplyImport(appCtx, rules, p)
+			return err
+		}
+
+		if *plan {
+			for _, c := range p.Changes {
+				fmt.Println(c.String())
+			}
+			return nil
+		}
+
+		b, err := json.MarshalIndent(rules, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	f.Usage()
+	return flag.ErrHelp
+}
+
+// pauseCommand pauses or resumes the reconciliation of the running instance by the api.
+func pauseCommand(name string, args []string) error {
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	addr := f.String("addr", fmt.Sprintf("http://127.0.0.1:%d", settings.Value().ServePort), "the address of the running instance")
+	reason := f.String("reason", "", "pause: the reason")
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if name == "pause" {
+		b, err := json.Marshal(map[string]string{"reason": *reason})
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(appCtx, http.MethodPost, strings.TrimSuffix(*addr, "/")+"/vapi/"+name, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s %s", name, res.Status, strings.TrimSpace(string(b)))
+	}
+	fmt.Println(strings.TrimSpace(string(b)))
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"hash"
 	"io"
@@ -67,6 +68,19 @@ func main() {
 		}
 	}()
 
+	if args := settings.Args(); len(args) > 0 {
+		err := command(args)
+		server.FlushAPICalls()
+		if err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			log.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
 	var ch = make(chan InotifyEvent, 1)
 	var changed = make(chan struct{}, 1)
 
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+// AuditEntry is a line of the audit trail.
+type AuditEntry struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Data  any       `json:"data"`
+}
+
+var auditMu sync.Mutex
+
+func auditFilename() string {
+	return filepath.Join(settings.Value().DataDirectory, "audit.log")
+}
+
+// audit appends the event to the audit trail in the data directory.
+func audit(event string, data any) {
+	b, err := json.Marshal(AuditEntry{Time: time.Now(), Event: event, Data: data})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(auditFilename()), 0o755); err != nil {
+		log.Error(err)
+		return
+	}
+
+	f, err := os.OpenFile(auditFilename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		log.Error(err)
+	}
+}
+
+func (s *Server) GetAudit(c *gin.Context) {
+	items := []*AuditEntry{}
+
+	f, err := os.Open(auditFilename())
+	if err != nil {
+		c.JSON(http.StatusOK, items)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var v *AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &v); err == nil {
+			items = append(items, v)
+		}
+	}
+
+	c.JSON(http.StatusOK, items)
+}
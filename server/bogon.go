@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+var (
+	cgnat     = netip.MustParsePrefix("100.64.0.0/10")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+type bogonPrefix struct {
+	prefix netip.Prefix
+	reason string
+}
+
+var bogons = []bogonPrefix{
+	{netip.MustParsePrefix("0.0.0.0/8"), "this network (RFC 791)"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private (RFC 1918)"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "CGNAT (RFC 6598)"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback (RFC 1122)"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local (RFC 3927)"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private (RFC 1918)"},
+	{netip.MustParsePrefix("192.0.0.0/24"), "IETF protocol assignments (RFC 6890)"},
+	{netip.MustParsePrefix("192.0.2.0/24"), "documentation (RFC 5737)"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private (RFC 1918)"},
+	{netip.MustParsePrefix("198.18.0.0/15"), "benchmarking (RFC 2544)"},
+	{netip.MustParsePrefix("198.51.100.0/24"), "documentation (RFC 5737)"},
+	{netip.MustParsePrefix("203.0.113.0/24"), "documentation (RFC 5737)"},
+	{netip.MustParsePrefix("224.0.0.0/4"), "multicast (RFC 5771)"},
+	{netip.MustParsePrefix("240.0.0.0/4"), "reserved (RFC 1112)"},
+	{netip.MustParsePrefix("::/128"), "unspecified (RFC 4291)"},
+	{netip.MustParsePrefix("::1/128"), "loopback (RFC 4291)"},
+	{netip.MustParsePrefix("::ffff:0:0/96"), "IPv4-mapped (RFC 4291)"},
+	{netip.MustParsePrefix("64:ff9b::/96"), "NAT64 (RFC 6052)"},
+	{netip.MustParsePrefix("64:ff9b:1::/48"), "local-use NAT64 (RFC 8215)"},
+	{netip.MustParsePrefix("100::/64"), "discard-only (RFC 6666)"},
+	{netip.MustParsePrefix("2001:db8::/32"), "documentation (RFC 3849)"},
+	{netip.MustParsePrefix("fc00::/7"), "unique local (RFC 4193)"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local (RFC 4291)"},
+	{netip.MustParsePrefix("fec0::/10"), "site-local (RFC 3879)"},
+	{netip.MustParsePrefix("ff00::/8"), "multicast (RFC 4291)"},
+}
+
+// bogon returns the reason why the address is not routable on the Internet, or empty if it is.
+func bogon(addr netip.Addr) string {
+	for _, b := range bogons {
+		if b.prefix.Contains(addr) {
+			return b.reason
+		}
+	}
+	if addr.Is6() && !netip.MustParsePrefix("2000::/3").Contains(addr) {
+		return "not global unicast (RFC 4291)"
+	}
+	// a 6to4 address is routable only if the embedded IPv4 address is
+	if sixToFour.Contains(addr) {
+		b := addr.As16()
+		v4 := netip.AddrFrom4([4]byte(b[2:6]))
+		if reason := bogon(v4); reason != "" {
+			return fmt.Sprintf("6to4 of %s (RFC 3056), %s", v4, reason)
+		}
+	}
+	return ""
+}
+
+// natted reports whether the address is behind a NAT, i.e. private or CGNAT.
+func natted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || cgnat.Contains(addr)
+}
+
+type BogonError struct {
+	Addr   netip.Addr
+	Reason string
+}
+
+func (e *BogonError) Error() string {
+	return fmt.Sprintf("rejected %s: %s", e.Addr, e.Reason)
+}
+
+// validateAddr parses the result of a detector, a bogon is rejected unless it is allowed by the config.
+func validateAddr(s string, family string) (netip.Addr, error) {
+	v := strings.TrimSpace(s)
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		if len(v) > 64 {
+			v = v[:64] + "..."
+		}
+		return netip.Addr{}, fmt.Errorf("invalid address: %q", v)
+	}
+
+	addr = addr.WithZone("")
+	if family == "ip4" {
+		addr = addr.Unmap()
+	}
+
+	if (family == "ip4") != addr.Is4() {
+		return netip.Addr{}, fmt.Errorf("unexpected address family: %s", addr)
+	}
+
+	reason := bogon(addr)
+	if reason == "" {
+		return addr, nil
+	}
+
+	for _, p := range settings.Value().Detect.Allow {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			if a, err := netip.ParseAddr(p); err == nil {
+				prefix = netip.PrefixFrom(a, a.BitLen())
+			}
+		}
+		if prefix.IsValid() && prefix.Contains(addr) {
+			return addr, nil
+		}
+	}
+
+	return addr, &BogonError{Addr: addr, Reason: reason}
+}
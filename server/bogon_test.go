@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestValidateAddr(t *testing.T) {
+	loadSettings(t, `{"detect": {"allow": ["192.168.1.0/24", "2001:db8::1"]}}`)
+
+	tests := []struct {
+		name   string
+		s      string
+		family string
+		want   string
+		bogon  bool
+		err    bool
+	}{
+		{name: "public", s: "1.1.1.1", family: "ip4", want: "1.1.1.1"},
+		{name: "public v6", s: "2606:4700::1111", family: "ip6", want: "2606:4700::1111"},
+		{name: "trimmed", s: " 1.1.1.1\n", family: "ip4", want: "1.1.1.1"},
+		{name: "zone", s: "2606:4700::1111%eth0", family: "ip6", want: "2606:4700::1111"},
+		{name: "private", s: "10.0.0.1", family: "ip4", want: "10.0.0.1", bogon: true},
+		{name: "allowed private", s: "192.168.1.10", family: "ip4", want: "192.168.1.10"},
+		{name: "CGNAT", s: "100.64.0.1", family: "ip4", want: "100.64.0.1", bogon: true},
+		{name: "loopback", s: "127.0.0.1", family: "ip4", want: "127.0.0.1", bogon: true},
+		{name: "documentation", s: "203.0.113.1", family: "ip4", want: "203.0.113.1", bogon: true},
+		{name: "documentation v6", s: "2001:db8::2", family: "ip6", want: "2001:db8::2", bogon: true},
+		{name: "allowed documentation v6", s: "2001:db8::1", family: "ip6", want: "2001:db8::1"},
+		{name: "unique local", s: "fd00::1", family: "ip6", want: "fd00::1", bogon: true},
+		{name: "link-local", s: "fe80::1", family: "ip6", want: "fe80::1", bogon: true},
+		{name: "mapped public", s: "::ffff:1.1.1.1", family: "ip4", want: "1.1.1.1"},
+		{name: "mapped private", s: "::ffff:10.0.0.1", family: "ip4", want: "10.0.0.1", bogon: true},
+		{name: "mapped as v6", s: "::ffff:1.1.1.1", family: "ip6", want: "::ffff:1.1.1.1", bogon: true},
+		{name: "NAT64", s: "64:ff9b::101:101", family: "ip6", want: "64:ff9b::101:101", bogon: true},
+		{name: "local-use NAT64", s: "64:ff9b:1::101:101", family: "ip6", want: "64:ff9b:1::101:101", bogon: true},
+		{name: "6to4 public", s: "2002:101:101::1", family: "ip6", want: "2002:101:101::1"},
+		{name: "6to4 private", s: "2002:a00:1::1", family: "ip6", want: "2002:a00:1::1", bogon: true},
+		{name: "6to4 CGNAT", s: "2002:6440:1::1", family: "ip6", want: "2002:6440:1::1", bogon: true},
+		{name: "v6 as v4", s: "2606:4700::1111", family: "ip4", err: true},
+		{name: "v4 as v6", s: "1.1.1.1", family: "ip6", err: true},
+		{name: "invalid", s: "<html>", family: "ip4", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := validateAddr(tt.s, tt.family)
+			var be *BogonError
+			switch {
+			case tt.err:
+				if err == nil || errors.As(err, &be) {
+					t.Fatalf("err = %v, want an invalid address", err)
+				}
+				return
+			case tt.bogon:
+				if !errors.As(err, &be) || be.Reason == "" {
+					t.Fatalf("err = %v, want a bogon", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+			if addr.String() != tt.want {
+				t.Errorf("addr = %s, want %s", addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestNatted(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"1.1.1.1", false},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"192.168.0.1", true},
+		{"100.64.0.1", true},
+		{"100.128.0.1", false},
+		{"::ffff:100.64.0.1", true},
+		{"::ffff:1.1.1.1", false},
+		{"fd00::1", true},
+		{"2606:4700::1111", false},
+	}
+
+	for _, tt := range tests {
+		if got := natted(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("natted(%s) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -3,13 +3,14 @@ package server
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -22,45 +23,25 @@ import (
 // https://developers.cloudflare.com/api/resources/dns/subresources/records/methods/list/
 
 var (
-	client  = &http.Client{}
-	client4 = &http.Client{}
-	client6 = &http.Client{}
+	client = &http.Client{}
 )
 
-func init() {
-	dial := &net.Dialer{}
-	{
-		t := &http.Transport{}
-		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dial.DialContext(ctx, "tcp4", addr)
-		}
-		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		client4.Transport = t
-		client4.Timeout = 30 * time.Second
-	}
-	{
-		t := &http.Transport{}
-		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dial.DialContext(ctx, "tcp6", addr)
-		}
-		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		client6.Transport = t
-		client6.Timeout = 30 * time.Second
-	}
-}
-
 type CloudflareError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
 
 type CloudflareRecord struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Content   string `json:"content"`
-	Proxiable bool   `json:"proxiable"`
-	Proxied   bool   `json:"proxied"`
-	Type      string `json:"type"`
+	ID        string                `json:"id"`
+	Name      string                `json:"name"`
+	Content   string                `json:"content"`
+	Proxiable bool                  `json:"proxiable"`
+	Proxied   bool                  `json:"proxied"`
+	Type      string                `json:"type"`
+	TTL       int                   `json:"ttl"`
+	Priority  *uint16               `json:"priority,omitempty"`
+	Data      *CloudflareRecordData `json:"data,omitempty"`
+	Comment   string                `json:"comment,omitempty"`
 }
 
 func (s *Server) ddns(ctx context.Context) {
@@ -78,149 +59,320 @@ func (s *Server) ddns(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
+			FlushAPICalls()
 			return
 		case <-s.apply:
-			if err := s.modify(ctx); err != nil {
+			err := s.modify(ctx)
+			if err != nil {
 				log.Error(err)
 			}
+			s.notifyFailure(err)
+			FlushAPICalls()
 		}
 	}
 }
 
-func GetInternetAddrs(ctx context.Context) (ipv4, ipv6 string, err error) {
-	// curl 'https://api.ipify.org'
-	// curl -6 'https://api64.ipify.org'
-	type Response struct {
-		Content string `json:"ip"`
+// trigger requests a reconciliation unless one is already pending.
+func (s *Server) trigger() {
+	select {
+	case s.apply <- struct{}{}:
+	default:
 	}
+}
+
+func GetInternetAddrs(ctx context.Context, w *wan) (ipv4, ipv6 string, results []DetectResult, err error) {
+	var results4, results6 []DetectResult
 
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-
-		var v Response
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
-		if err := request(ctx, client4, "GET", "https://api.ipify.org?format=json", &v, nil); err != nil {
-			// nothing
-		}
-		ipv4 = v.Content
+		ipv4, results4, _ = DetectAddr(ctx, w, "ip4")
 	}()
 
 	go func() {
 		defer wg.Done()
-		if settings.Value().StaticIPv6 != "" {
+		if w.staticIPv6 != "" {
+			ipv6 = w.staticIPv6
+			return
+		}
+		if w == defaultWAN && settings.Value().StaticIPv6 != "" {
 			ipv6 = settings.Value().StaticIPv6
 			return
 		}
-		ipv6, _ = OutboundIPv6()
+		ipv6, results6, _ = DetectAddr(ctx, w, "ip6")
 	}()
 
 	wg.Wait()
 
+	results = append(results4, results6...)
+
 	if ipv4 == "" && ipv6 == "" {
-		return "", "", errors.New("Get Internet IPs failed.")
+		return "", "", results, fmt.Errorf("Get Internet IPs failed. (wan: %s)", w)
 	}
 
 	return
 }
 
+// discover detects the addresses of the default route and every WAN.
+//
+// A changed address is held back by the stability condition unless immediate.
+func (s *Server) discover(ctx context.Context, immediate bool) (*Discovery, error) {
+	var mu sync.Mutex
+	wg := &sync.WaitGroup{}
+
+	d := NewDiscovery("", "")
+	var errs []error
+	var results []DetectResult
+
+	detect := func(w *wan, d *Discovery) {
+		defer wg.Done()
+		ipv4, ipv6, r, err := GetInternetAddrs(ctx, w)
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, r...)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		d.ipv4 = s.stability.update(w, "ip4", ipv4, immediate)
+		d.ipv6 = s.stability.update(w, "ip6", ipv6, immediate)
+		if ipv6 == "" {
+			log.Warnf("Internet v6 not found. (wan: %s)", w)
+		}
+	}
+
+	wg.Add(1 + len(s.wans))
+	go detect(defaultWAN, d)
+	for name, w := range s.wans {
+		v := NewDiscovery("", "")
+		v.wans = d.wans
+		d.wans[name] = v
+		go detect(w, v)
+	}
+	wg.Wait()
+
+	s.status.setDetected(results)
+
+	if len(errs) == 1+len(s.wans) {
+		return nil, errors.Join(errs...)
+	}
+
+	for _, err := range errs {
+		log.Warn(err)
+	}
+
+	return d, nil
+}
+
 func (s *Server) modify(ctx context.Context) error {
-	ipv4, ipv6, err := GetInternetAddrs(ctx)
+	d, err := s.discover(ctx, s.immediate.Swap(false))
 	if err != nil {
 		return err
 	}
 
-	if ipv6 == "" {
-		log.Warn("Internet v6 not found.")
+	s.restoreProxy()
+	desired := s.applyProxyOverrides(s.desiredRecords(settings.Value().Records, d))
+	if s.responder != nil {
+		s.responder.set(desired, s.lanRecords(d))
+	}
+	if s.writable() == nil {
+		s.syncProviders(ctx, desired)
+	}
+	digest := digestRecords(desired, desiredLists(d))
+
+	// a run of the unchanged records only lists them to detect a drift
+	full := s.resync.Swap(false) || !s.upToDate(ctx, digest, desired)
+	if !full && !s.driftCheckDue() {
+		log.Debug("records are up to date")
+		return nil
 	}
 
-	records, err := getRecords(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := cloudflare.Records(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	// add not exists
-	for _, rule := range settings.Value().Records {
-		var exists bool
-		for _, r := range records {
-			if r.Name == rule.Name && r.Type == rule.Type {
-				exists = true
-				break
-			}
-		}
+	planned, applied := s.detectDrift(records, desired)
 
-		if exists {
-			continue
-		}
+	plan := planRecords(records, planned, managed)
 
-		switch rule.Type {
-		case "A":
-			if ipv4 != "" {
-				if err := addRecord(ctx, rule.Name, rule.Type, ipv4); err != nil {
-					log.Error(err)
-				} else {
-					log.Infof("ADD record: {%s %s: %s}", rule.Type, rule.Name, ipv4)
-				}
-			}
-		case "AAAA":
-			if ipv6 != "" {
-				if err := addRecord(ctx, rule.Name, rule.Type, ipv6); err != nil {
-					log.Error(err)
-				} else {
-					log.Infof("ADD record: {%s %s: %s}", rule.Type, rule.Name, ipv6)
-				}
-			}
-		}
+	if err := s.writable(); err != nil {
+		skipPlan(plan, err)
+		return nil
 	}
 
-	for _, r := range records {
-		var exists bool
-		for _, v := range settings.Value().Records {
-			if r.Name == v.Name && r.Type == v.Type {
-				exists = true
-				break
-			}
+	if !plan.Empty() {
+		if _, err := takeSnapshot(records, "apply"); err != nil {
+			return fmt.Errorf("snapshot: %w", err)
 		}
+	}
 
-		// delete if not found
-		if !exists {
-			if err := deleteRecord(ctx, r.ID); err != nil {
-				log.Error(err)
-			} else {
-				log.Infof("DELETE record: {%s %s: %s}", r.Type, r.Name, r.Content)
-			}
-			continue
+	changes, err := plan.Apply(ctx, cloudflare)
+	s.notifyChanges(changes)
+	s.verifyPropagation(ctx, changes)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if !full {
+		return s.state.Update(func(v *State) {
+			v.Applied = &Applied{Zone: settings.Value().ZoneID, Digest: digest, Records: applied, SyncedAt: v.Applied.SyncedAt, CheckedAt: now}
+		})
+	}
+
+	if err := errors.Join(s.syncReverse(ctx, desired), s.syncLists(ctx, d)); err != nil {
+		return err
+	}
+
+	return s.state.Update(func(v *State) {
+		v.Applied = &Applied{Zone: settings.Value().ZoneID, Digest: digest, Records: applied, SyncedAt: now, CheckedAt: now}
+	})
+}
+
+// driftCheckDue reports whether the drift check interval has expired since the last listing of the records.
+func (s *Server) driftCheckDue() bool {
+	interval := settings.Value().Sync.DriftCheck.Value()
+	if interval < 0 {
+		return false
+	}
+	if interval == 0 {
+		interval = 15 * time.Minute
+	}
+	v := s.state.Load().Applied
+	if v == nil {
+		return true
+	}
+	checked := v.CheckedAt
+	if checked.Before(v.SyncedAt) {
+		checked = v.SyncedAt
+	}
+	return time.Since(checked) >= interval
+}
+
+// digestRecords returns the hash of the desired records and list items with the zone and the rules,
+// a change of the rules makes the unmanaged records to be deleted.
+func digestRecords(desired, lists []CloudflareRecord) string {
+	b, _ := json.Marshal(struct {
+		Zone    string
+		Rules   []settings.Record
+		Reverse []settings.ReverseZone
+		Lists   []settings.List
+		Records []string
+		Items   []string
+	}{settings.Value().ZoneID, settings.Value().Records, settings.Value().ReverseZones, settings.Value().Lists, signatures(desired), signatures(lists)})
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// upToDate reports whether the desired records are the same as the last applied ones within
+// the resync interval, and optionally whether the authoritative nameservers serve them.
+func (s *Server) upToDate(ctx context.Context, digest string, desired []CloudflareRecord) bool {
+	v := s.state.Load().Applied
+	if v == nil || v.Digest != digest {
+		return false
+	}
+
+	resync := settings.Value().Sync.Resync.Value()
+	if resync <= 0 {
+		resync = 6 * time.Hour
+	}
+	if time.Since(v.SyncedAt) >= resync {
+		log.Debug("records: resync")
+		return false
+	}
+
+	if !settings.Value().Sync.VerifyNameServers {
+		return true
+	}
+
+	zone, err := s.zone(ctx)
+	if err != nil {
+		log.Warn(err)
+		return false
+	}
+
+	if err := verifyRecords(ctx, zone.NameServers, desired); err != nil {
+		log.Warn(err)
+		return false
+	}
+
+	return true
+}
+
+func RequestCloudflare(ctx context.Context, method, path string, body io.Reader, resData any) error {
+	return RequestCloudflareZone(ctx, settings.Value().ZoneID, method, path, body, resData)
+}
+
+// RequestCloudflareZone requests the api of the zone, which is not necessarily the configured one.
+func RequestCloudflareZone(ctx context.Context, zone, method, path string, body io.Reader, resData any) error {
+	return RequestCloudflareAPI(ctx, method, "/zones/"+zone+path, body, resData)
+}
+
+// RequestCloudflareAPI requests the api with the credentials, a request which is rate limited
+// or an idempotent one failed by the server is retried.
+func RequestCloudflareAPI(ctx context.Context, method, path string, body io.Reader, resData any) error {
+	var data []byte
+	if body != nil {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return err
 		}
+		data = b
+	}
 
-		// patch
-		switch r.Type {
-		case "A":
-			if ipv4 != "" && r.Content != ipv4 {
-				if err := patchRecord(ctx, r, ipv4); err != nil {
-					log.Error(err)
-				} else {
-					log.Infof("PATCH record: {%s %s: %s}", r.Type, r.Name, ipv4)
-				}
-			}
-		case "AAAA":
-			if ipv6 != "" && r.Content != ipv6 {
-				if err := patchRecord(ctx, r, ipv6); err != nil {
-					log.Error(err)
-				} else {
-					log.Infof("PATCH record: {%s %s: %s}", r.Type, r.Name, ipv6)
-				}
+	for attempt := 1; ; attempt++ {
+		err := requestCloudflare(ctx, method, path, data, body != nil, resData)
+		var retry *retryError
+		if !errors.As(err, &retry) || attempt >= cloudflareAttempts {
+			if retry != nil {
+				err = retry.err
 			}
+			countAPICall(attempt, err)
+			return err
+		}
+		log.Debugf("cloudflare: %s, retry after %s", retry.err, retry.after)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry.after):
 		}
 	}
+}
 
-	return nil
+const cloudflareAttempts = 3
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
 }
 
-func RequestCloudflare(ctx context.Context, method, path string, body io.Reader, resData any) error {
-	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s", settings.Value().ZoneID)+path, body)
+// retryError is the failure of a request which is worth retrying after a while.
+type retryError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+func requestCloudflare(ctx context.Context, method, path string, data []byte, hasBody bool, resData any) error {
+	var body io.Reader
+	if hasBody {
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.cloudflare.com/client/v4"+path, body)
 	if err != nil {
 		return err
 	}
@@ -241,6 +393,16 @@ func RequestCloudflare(ctx context.Context, method, path string, body io.Reader,
 		return err
 	}
 
+	// a rate limited request is not processed, while a failed one may be done already,
+	// e.g. a created record, so that it is retried only if it is idempotent
+	if res.StatusCode == http.StatusTooManyRequests || (res.StatusCode >= 500 && idempotent(req.Method)) {
+		after := 2 * time.Second
+		if v, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && v > 0 {
+			after = time.Duration(v) * time.Second
+		}
+		return &retryError{fmt.Errorf("cloudflare: %s %s %s", res.Status, req.Method, req.URL), after}
+	}
+
 	buf := &bytes.Buffer{}
 	if _, err := io.Copy(buf, res.Body); err != nil {
 		return err
@@ -298,60 +460,47 @@ func request(ctx context.Context, client *http.Client, method, url string, resDa
 	return json.Unmarshal(buf.Bytes(), resData)
 }
 
-func addRecord(ctx context.Context, fullName string, typ string, ip string) error {
-	type Record struct {
-		Name    string `json:"name"`
-		Content string `json:"content"`
-		Type    string `json:"type"`
-		Proxied bool   `json:"proxied"`
-	}
-
-	b, err := json.Marshal(Record{
-		Name:    fullName,
-		Type:    typ,
-		Content: ip,
-		Proxied: false,
-	})
+func addRecord(ctx context.Context, zone string, record CloudflareRecord) error {
+	b, err := json.Marshal(recordBody(record))
 	if err != nil {
 		return err
 	}
 
-	return RequestCloudflare(ctx, "POST", "/dns_records", bytes.NewBuffer(b), nil)
+	return RequestCloudflareZone(ctx, zone, "POST", "/dns_records", bytes.NewBuffer(b), nil)
 }
 
-func patchRecord(ctx context.Context, record CloudflareRecord, ip string) error {
-	type Record struct {
-		Name    string `json:"name"`
-		Content string `json:"content"`
-		Type    string `json:"type"`
-		Proxied bool   `json:"proxied"`
-	}
-
-	b, err := json.Marshal(Record{
-		Name:    record.Name,
-		Type:    record.Type,
-		Content: ip,
-		Proxied: false,
-	})
+func patchRecord(ctx context.Context, zone string, record CloudflareRecord, want CloudflareRecord) error {
+	b, err := json.Marshal(recordBody(want))
 	if err != nil {
 		return err
 	}
 
-	return RequestCloudflare(ctx, "PATCH", "/dns_records/"+record.ID, bytes.NewBuffer(b), nil)
+	return RequestCloudflareZone(ctx, zone, "PATCH", "/dns_records/"+record.ID, bytes.NewBuffer(b), nil)
 }
 
-func deleteRecord(ctx context.Context, id string) error {
-	return RequestCloudflare(ctx, "DELETE", fmt.Sprintf("/dns_records/%s", id), nil, nil)
+func deleteRecord(ctx context.Context, zone string, id string) error {
+	return RequestCloudflareZone(ctx, zone, "DELETE", fmt.Sprintf("/dns_records/%s", id), nil, nil)
 }
 
 func getRecords(ctx context.Context) ([]CloudflareRecord, error) {
-	var result struct {
-		Data    []CloudflareRecord `json:"result"`
-		Errors  []CloudflareError  `json:"errors"`
-		Success bool               `json:"success"`
-	}
-	if err := RequestCloudflare(ctx, "GET", "/dns_records", nil, &result); err != nil {
-		return nil, err
+	return getZoneRecords(ctx, settings.Value().ZoneID)
+}
+
+func getZoneRecords(ctx context.Context, zone string) ([]CloudflareRecord, error) {
+	var records []CloudflareRecord
+	for page := 1; ; page++ {
+		var result struct {
+			Data       []CloudflareRecord `json:"result"`
+			ResultInfo struct {
+				TotalPages int `json:"total_pages"`
+			} `json:"result_info"`
+		}
+		if err := RequestCloudflareZone(ctx, zone, "GET", fmt.Sprintf("/dns_records?page=%d&per_page=5000", page), nil, &result); err != nil {
+			return nil, err
+		}
+		records = append(records, result.Data...)
+		if page >= result.ResultInfo.TotalPages {
+			return records, nil
+		}
 	}
-	return result.Data, nil
 }
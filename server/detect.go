@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var ErrUnsupportedFamily = errors.New("unsupported address family")
+
+// Detector detects the public address of the family ("ip4" or "ip6") through the WAN.
+type Detector interface {
+	Detect(ctx context.Context, w *wan, family string) (string, error)
+}
+
+type httpDetector struct{}
+
+func (httpDetector) Detect(ctx context.Context, w *wan, family string) (string, error) {
+	// curl 'https://api.ipify.org'
+	// curl -6 'https://api6.ipify.org'
+	type Response struct {
+		Content string `json:"ip"`
+	}
+
+	var v Response
+	var err error
+	if family == "ip4" {
+		err = request(ctx, w.client4, "GET", "https://api.ipify.org?format=json", &v, nil)
+	} else {
+		err = request(ctx, w.client6, "GET", "https://api6.ipify.org?format=json", &v, nil)
+	}
+	return v.Content, err
+}
+
+// outboundDetector returns the local address of the outbound route, it is only meaningful for IPv6.
+type outboundDetector struct{}
+
+func (outboundDetector) Detect(ctx context.Context, w *wan, family string) (string, error) {
+	if family != "ip6" {
+		return "", ErrUnsupportedFamily
+	}
+	return OutboundIPv6(ctx, w)
+}
+
+type dnsQuestion struct {
+	name    string
+	typ4    dnsmessage.Type
+	typ6    dnsmessage.Type
+	class   dnsmessage.Class
+	server4 string
+	server6 string
+}
+
+var dnsProviders = map[string]dnsQuestion{
+	// dig @1.1.1.1 whoami.cloudflare CH TXT
+	"cloudflare": {
+		name:    "whoami.cloudflare.",
+		typ4:    dnsmessage.TypeTXT,
+		typ6:    dnsmessage.TypeTXT,
+		class:   dnsmessage.Class(3), // CHAOS
+		server4: "1.1.1.1:53",
+		server6: "[2606:4700:4700::1111]:53",
+	},
+	// dig @resolver1.opendns.com myip.opendns.com A
+	"opendns": {
+		name:    "myip.opendns.com.",
+		typ4:    dnsmessage.TypeA,
+		typ6:    dnsmessage.TypeAAAA,
+		class:   dnsmessage.ClassINET,
+		server4: "208.67.222.222:53",
+		server6: "[2620:119:35::35]:53",
+	},
+	// dig @ns1.google.com o-o.myaddr.l.google.com TXT
+	"google": {
+		name:    "o-o.myaddr.l.google.com.",
+		typ4:    dnsmessage.TypeTXT,
+		typ6:    dnsmessage.TypeTXT,
+		class:   dnsmessage.ClassINET,
+		server4: "216.239.32.10:53",
+		server6: "[2001:4860:4802:32::a]:53",
+	},
+}
+
+type dnsDetector struct {
+	provider string
+	server   string
+	network  string
+}
+
+func (d *dnsDetector) Detect(ctx context.Context, w *wan, family string) (string, error) {
+	q, exists := dnsProviders[d.provider]
+	if !exists {
+		return "", fmt.Errorf("dns provider %s: not found", d.provider)
+	}
+
+	typ, server := q.typ4, q.server4
+	if family == "ip6" {
+		typ, server = q.typ6, q.server6
+	}
+	if d.server != "" {
+		server = d.server
+	}
+
+	network := d.network + family[2:]
+
+	res, err := DNSQuery(ctx, w, network, server, q.name, typ, q.class)
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range res.Answers {
+		switch v := a.Body.(type) {
+		case *dnsmessage.AResource:
+			if family == "ip4" {
+				return netip.AddrFrom4(v.A).String(), nil
+			}
+		case *dnsmessage.AAAAResource:
+			if family == "ip6" {
+				return netip.AddrFrom16(v.AAAA).String(), nil
+			}
+		case *dnsmessage.TXTResource:
+			if addr, err := netip.ParseAddr(dnsTXT(v)); err == nil {
+				return addr.String(), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("dns: %s %s: no address in the answer", q.name, typ)
+}
+
+func newDetector(name string) (Detector, error) {
+	switch name {
+	case "http":
+		return httpDetector{}, nil
+	case "outbound":
+		return outboundDetector{}, nil
+	case "stun":
+		servers := settings.Value().Detect.STUNServers
+		if len(servers) == 0 {
+			servers = DefaultSTUNServers
+		}
+		return &stunDetector{servers: servers}, nil
+	case "dns":
+		v := settings.Value().Detect
+		d := &dnsDetector{provider: v.DNSProvider, server: v.DNSServer, network: v.DNSNetwork}
+		if d.provider == "" {
+			d.provider = "cloudflare"
+		}
+		if d.network == "" {
+			d.network = "udp"
+		}
+		if d.network != "udp" && d.network != "tcp" {
+			return nil, fmt.Errorf("detector dns: unsupported network: %q", d.network)
+		}
+		return d, nil
+	case "upnp":
+		return upnpDetector{}, nil
+	case "natpmp":
+		return natpmpDetector{}, nil
+	case "pcp":
+		return pcpDetector{}, nil
+	}
+	return nil, fmt.Errorf("detector %s: not found", name)
+}
+
+func detectors(family string) []string {
+	if family == "ip4" {
+		if v := settings.Value().Detect.IPv4; len(v) > 0 {
+			return v
+		}
+		return []string{"http"}
+	}
+	if v := settings.Value().Detect.IPv6; len(v) > 0 {
+		return v
+	}
+	return []string{"outbound"}
+}
+
+type DetectResult struct {
+	WAN       string `json:"wan"`
+	Family    string `json:"family"`
+	Detector  string `json:"detector"`
+	Addr      string `json:"addr,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Rejected  bool   `json:"rejected,omitempty"`
+	DoubleNAT bool   `json:"double_nat,omitempty"`
+}
+
+// DetectAddr queries the detectors of the family in parallel. The result of the first successful
+// detector in order is returned, a disagreement of the others is logged.
+func DetectAddr(ctx context.Context, w *wan, family string) (string, []DetectResult, error) {
+	names := detectors(family)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	addrs := make([]string, len(names))
+	errs := make([]error, len(names))
+
+	wg := &sync.WaitGroup{}
+	for i, name := range names {
+		d, err := newDetector(name)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, d Detector) {
+			defer wg.Done()
+			addrs[i], errs[i] = d.Detect(ctx, w, family)
+			if errs[i] != nil {
+				return
+			}
+			if addrs[i] == "" {
+				errs[i] = errors.New("empty result")
+				return
+			}
+			addr, err := validateAddr(addrs[i], family)
+			if addr.IsValid() {
+				addrs[i] = addr.String()
+			}
+			errs[i] = err
+		}(i, d)
+	}
+	wg.Wait()
+
+	var results []DetectResult
+	var addr, from string
+	for i, name := range names {
+		if errors.Is(errs[i], ErrUnsupportedFamily) {
+			continue
+		}
+
+		r := DetectResult{WAN: w.String(), Family: family, Detector: name, Addr: addrs[i]}
+		results = append(results, r)
+
+		if errs[i] != nil {
+			r.Error = errs[i].Error()
+			var e *DoubleNATError
+			var b *BogonError
+			if errors.As(errs[i], &e) {
+				r.DoubleNAT = true
+				r.Addr = e.Addr.String()
+				log.Warnf("detect %s (wan: %s, detector: %s): %s", family, w, name, e)
+			} else if errors.As(errs[i], &b) {
+				r.Rejected = true
+				r.DoubleNAT = natted(b.Addr)
+				log.Warnf("detect %s (wan: %s, detector: %s): %s", family, w, name, b)
+			} else {
+				log.Debugf("detect %s (wan: %s, detector: %s): %s", family, w, name, errs[i])
+			}
+			results[len(results)-1] = r
+			continue
+		}
+
+		if addr == "" {
+			addr, from = addrs[i], name
+			continue
+		}
+		if addrs[i] != addr {
+			log.Warnf("detect %s (wan: %s): %s reports %s, but %s reports %s", family, w, name, addrs[i], from, addr)
+		}
+	}
+
+	if addr == "" {
+		return "", results, fmt.Errorf("detect %s (wan: %s): %w", family, w, errors.Join(errs...))
+	}
+
+	return addr, results, nil
+}
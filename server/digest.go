@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+const EventDigest = "digest"
+
+// digestItems is the maximum number of the items of a kind in a digest.
+const digestItems = 100
+
+// Digest is what happens since the last daily digest, which is kept in the data directory.
+type Digest struct {
+	Since     time.Time `json:"since"`
+	Addresses []Event   `json:"addresses,omitempty"`
+	Records   []Event   `json:"records,omitempty"`
+	Drifts    []Event   `json:"drifts,omitempty"`
+	Failures  []Event   `json:"failures,omitempty"`
+	// the number of the failed runs
+	Errors    int `json:"errors"`
+	APICalls  int `json:"api_calls"`
+	APIErrors int `json:"api_errors"`
+}
+
+var digestMu sync.Mutex
+
+func digestFilename() string {
+	return filepath.Join(settings.Value().DataDirectory, "digest.json")
+}
+
+func digestEnabled() bool {
+	v := settings.Value().Notify.SMTP
+	return v.Host != "" && v.Digest != ""
+}
+
+func loadDigest() (*Digest, error) {
+	v := &Digest{Since: time.Now()}
+	b, err := os.ReadFile(digestFilename())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return v, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// collectDigest modifies the digest if it is enabled.
+func collectDigest(fn func(d *Digest)) {
+	if !digestEnabled() {
+		return
+	}
+
+	digestMu.Lock()
+	defer digestMu.Unlock()
+
+	d, err := loadDigest()
+	if err != nil {
+		log.Warn("digest:", err)
+		d = &Digest{Since: time.Now()}
+	}
+	fn(d)
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err := zok.WriteFile(digestFilename(), b, 0o600); err != nil {
+		log.Error(fmt.Errorf("digest: %w", err))
+	}
+}
+
+// the calls of the Cloudflare API since the last flush, which are not written per call
+var apiCalls, apiErrors atomic.Int64
+
+// countAPICall counts the attempts of a call of the Cloudflare API.
+func countAPICall(attempts int, err error) {
+	apiCalls.Add(int64(attempts))
+	if err != nil {
+		apiErrors.Add(1)
+	}
+}
+
+// FlushAPICalls adds the counted calls of the Cloudflare API to the digest, once per run.
+func FlushAPICalls() {
+	calls, errs := apiCalls.Swap(0), apiErrors.Swap(0)
+	if calls == 0 && errs == 0 {
+		return
+	}
+	collectDigest(func(d *Digest) {
+		d.APICalls += int(calls)
+		d.APIErrors += int(errs)
+	})
+}
+
+func appendItem(items []Event, e Event) []Event {
+	if len(items) >= digestItems {
+		return items
+	}
+	e.Data = nil
+	return append(items, e)
+}
+
+// collectEvent adds the event to the digest.
+func collectEvent(e Event) {
+	collectDigest(func(d *Digest) {
+		switch e.Type {
+		case EventAddress:
+			d.Addresses = appendItem(d.Addresses, e)
+		case EventRecordCreate, EventRecordUpdate, EventRecordDelete:
+			d.Records = appendItem(d.Records, e)
+		case EventDrift:
+			d.Drifts = appendItem(d.Drifts, e)
+		case EventFailure:
+			d.Failures = appendItem(d.Failures, e)
+		}
+	})
+}
+
+// takeDigest returns the digest and starts a new one.
+func takeDigest() (*Digest, error) {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+
+	d, err := loadDigest()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(&Digest{Since: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	if err := zok.WriteFile(digestFilename(), b, 0o600); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// String returns the digest in plain text.
+func (d *Digest) String() string {
+	buf := &strings.Builder{}
+	const layout = "2006-01-02 15:04:05"
+
+	items := func(title string, items []Event) {
+		fmt.Fprintf(buf, "%s: %d\n", title, len(items))
+		for _, e := range items {
+			fmt.Fprintf(buf, "  %s  %s\n", e.Time.Local().Format(layout), e.Message)
+		}
+		if len(items) >= digestItems {
+			buf.WriteString("  ...\n")
+		}
+		buf.WriteString("\n")
+	}
+
+	fmt.Fprintf(buf, "Since %s\n\n", d.Since.Local().Format(layout))
+	items("Address changes", d.Addresses)
+	items("Records touched", d.Records)
+	items("Drifts", d.Drifts)
+	items("Failures", d.Failures)
+	fmt.Fprintf(buf, "Failed runs: %d\n", d.Errors)
+	fmt.Fprintf(buf, "Cloudflare API calls: %d (errors: %d)\n", d.APICalls, d.APIErrors)
+	return buf.String()
+}
+
+// nextDigest returns the next time of the daily digest at the local time of the day.
+func nextDigest(at string, now time.Time) (time.Time, error) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// sendDigests queues the daily digest until the context is done.
+func (s *Server) sendDigests(ctx context.Context) {
+	for {
+		next, err := nextDigest(settings.Value().Notify.SMTP.Digest, time.Now())
+		if err != nil {
+			log.Error(fmt.Errorf("digest: %w", err))
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		FlushAPICalls()
+		d, err := takeDigest()
+		if err != nil {
+			log.Error(fmt.Errorf("digest: %w", err))
+			continue
+		}
+		s.notify(EventDigest, d.String(), d)
+	}
+}
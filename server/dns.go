@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var ErrDNSMismatch = errors.New("dns: response mismatch")
+
+// DNSExchange sends the message to the server over the network ("udp" or "tcp", optionally
+// suffixed with "4" or "6") through the WAN, a truncated udp response is retried over tcp.
+func DNSExchange(ctx context.Context, w *wan, network, server string, msg *dnsmessage.Message) (*dnsmessage.Message, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	msg.ID = binary.BigEndian.Uint16(id[:])
+
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	res, _, err := dnsExchangeWire(ctx, w, network, server, b)
+	return res, err
+}
+
+// dnsExchangeWire is DNSExchange of a packed message, the packed response is returned as well.
+func dnsExchangeWire(ctx context.Context, w *wan, network, server string, b []byte) (*dnsmessage.Message, []byte, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	res, raw, err := dnsExchange(ctx, w, network, server, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if res.Truncated && strings.HasPrefix(network, "udp") {
+		return dnsExchange(ctx, w, "tcp"+network[3:], server, b)
+	}
+
+	return res, raw, nil
+}
+
+func dnsExchange(ctx context.Context, w *wan, network, server string, b []byte) (*dnsmessage.Message, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conn, err := w.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	id := binary.BigEndian.Uint16(b)
+	stream := strings.HasPrefix(network, "tcp")
+
+	if stream {
+		buf := make([]byte, 2+len(b))
+		binary.BigEndian.PutUint16(buf, uint16(len(b)))
+		copy(buf[2:], b)
+		if _, err := conn.Write(buf); err != nil {
+			return nil, nil, err
+		}
+	} else if _, err := conn.Write(b); err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		var buf []byte
+		if stream {
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err != nil {
+				return nil, nil, err
+			}
+			buf = make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			buf = make([]byte, 65535)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, nil, err
+			}
+			buf = buf[:n]
+		}
+
+		res := &dnsmessage.Message{}
+		if err := res.Unpack(buf); err != nil {
+			if stream {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		if res.ID != id || !res.Response {
+			if stream {
+				return nil, nil, ErrDNSMismatch
+			}
+			continue
+		}
+
+		return res, buf, nil
+	}
+}
+
+// DNSQuery asks the server for the records of the name.
+func DNSQuery(ctx context.Context, w *wan, network, server, name string, typ dnsmessage.Type, class dnsmessage.Class) (*dnsmessage.Message, error) {
+	n, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: n, Type: typ, Class: class},
+		},
+	}
+
+	res, err := DNSExchange(ctx, w, network, server, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.RCode != dnsmessage.RCodeSuccess {
+		return res, fmt.Errorf("dns: %s %s: %s", name, typ, res.RCode)
+	}
+
+	return res, nil
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// dnsTXT returns the joined strings of the TXT resource.
+func dnsTXT(r *dnsmessage.TXTResource) string {
+	return strings.Join(r.TXT, "")
+}
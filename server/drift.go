@@ -0,0 +1,240 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+const (
+	DriftContent = "content"
+	DriftProxied = "proxied"
+	DriftTTL     = "ttl"
+)
+
+const (
+	DriftCorrect = "correct"
+	DriftAlert   = "alert"
+	DriftAdopt   = "adopt"
+)
+
+// DriftEvent is a live record which differs from the last applied one.
+type DriftEvent struct {
+	Record string `json:"record"`
+	Kind   string `json:"kind"`
+	// the policy taken: correct, alert, adopt
+	Policy string            `json:"policy"`
+	Before *CloudflareRecord `json:"before,omitempty"`
+	After  *CloudflareRecord `json:"after,omitempty"`
+}
+
+func (e DriftEvent) String() string {
+	before, after := "none", "none"
+	switch e.Kind {
+	case DriftProxied:
+		before, after = fmt.Sprint(e.Before.Proxied), fmt.Sprint(e.After.Proxied)
+	case DriftTTL:
+		before, after = fmt.Sprint(e.Before.TTL), fmt.Sprint(e.After.TTL)
+	default:
+		if e.Before != nil {
+			before = e.Before.Value()
+		}
+		if e.After != nil {
+			after = e.After.Value()
+		}
+	}
+	return fmt.Sprintf("drift {%s}: %s %s -> %s (%s)", e.Record, e.Kind, before, after, e.Policy)
+}
+
+// Adoption is the live records which take the place of the desired ones,
+// until the desired records change.
+type Adoption struct {
+	Desired []string           `json:"desired"`
+	Records []CloudflareRecord `json:"records"`
+}
+
+// recordSignature identifies the record data with proxied and ttl.
+func recordSignature(r CloudflareRecord) string {
+	return fmt.Sprintf("%s %t %d", r, r.Proxied, r.TTL)
+}
+
+func signatures(records []CloudflareRecord) []string {
+	values := make([]string, 0, len(records))
+	for _, r := range records {
+		values = append(values, recordSignature(r))
+	}
+	slices.Sort(values)
+	return values
+}
+
+// converged reports whether the live records need no change to match the desired ones.
+func converged(live, desired []CloudflareRecord) bool {
+	return planRecords(live, desired, func(recordKey) bool { return true }).Empty()
+}
+
+// diffDrift classifies the differences of the live records from the applied ones.
+func diffDrift(k recordKey, applied, live []CloudflareRecord) []DriftEvent {
+	var events []DriftEvent
+	var missing []CloudflareRecord
+	extra := slices.Clone(live)
+
+	for _, a := range applied {
+		i := slices.IndexFunc(extra, func(r CloudflareRecord) bool { return sameValue(r, a) })
+		if i < 0 {
+			missing = append(missing, a)
+			continue
+		}
+		before, after := a, extra[i]
+		extra = slices.Delete(extra, i, i+1)
+		if proxiable(a.Type) && before.Proxied != after.Proxied {
+			events = append(events, DriftEvent{Record: k.String(), Kind: DriftProxied, Before: &before, After: &after})
+		} else if !after.Proxied && before.TTL != after.TTL {
+			events = append(events, DriftEvent{Record: k.String(), Kind: DriftTTL, Before: &before, After: &after})
+		}
+	}
+
+	for i := 0; i < max(len(missing), len(extra)); i++ {
+		e := DriftEvent{Record: k.String(), Kind: DriftContent}
+		if i < len(missing) {
+			e.Before = &missing[i]
+		}
+		if i < len(extra) {
+			e.After = &extra[i]
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func driftPolicy(k recordKey) string {
+	for _, v := range settings.Value().Records {
+		if keyOf(v.Name, v.Type) != k || v.Drift == "" {
+			continue
+		}
+		switch v.Drift {
+		case DriftCorrect, DriftAlert, DriftAdopt:
+			return v.Drift
+		}
+		log.Warnf("record {%s}: unknown drift policy: %s", k, v.Drift)
+	}
+	return DriftCorrect
+}
+
+// detectDrift compares the live records with the last applied ones, and applies the policy of the record
+// to a drift. It returns the desired records to plan and the records considered as applied after the plan.
+//
+// A record of which the desired value has changed since the last apply is updated regardless of the policy.
+// A record under alert is left untouched, and an adopted record is kept until the desired value changes.
+func (s *Server) detectDrift(live, desired []CloudflareRecord) (planned, applied []CloudflareRecord) {
+	st := s.state.Load()
+
+	var keys []recordKey
+	wants := map[recordKey][]CloudflareRecord{}
+	for _, r := range desired {
+		k := keyOf(r.Name, r.Type)
+		if _, exists := wants[k]; !exists {
+			keys = append(keys, k)
+		}
+		wants[k] = append(wants[k], r)
+	}
+
+	lives := map[recordKey][]CloudflareRecord{}
+	for _, r := range live {
+		k := keyOf(r.Name, r.Type)
+		lives[k] = append(lives[k], r)
+	}
+
+	last := map[recordKey][]CloudflareRecord{}
+	if st.Applied != nil && st.Applied.Zone == settings.Value().ZoneID {
+		for _, r := range st.Applied.Records {
+			k := keyOf(r.Name, r.Type)
+			last[k] = append(last[k], r)
+		}
+	}
+
+	adopted := map[string]Adoption{}
+	reported := map[string]string{}
+	var events []DriftEvent
+
+	for _, k := range keys {
+		want := wants[k]
+		rendered := signatures(want)
+
+		if a, exists := st.Adopted[k.String()]; exists && slices.Equal(a.Desired, rendered) {
+			adopted[k.String()] = a
+			want = a.Records
+		}
+
+		prev, exists := last[k]
+		if !exists || converged(lives[k], want) {
+			planned = append(planned, want...)
+			applied = append(applied, want...)
+			continue
+		}
+
+		drift := diffDrift(k, prev, lives[k])
+		if len(drift) == 0 {
+			planned = append(planned, want...)
+			applied = append(applied, want...)
+			continue
+		}
+
+		policy := DriftCorrect
+		if converged(prev, want) {
+			policy = driftPolicy(k)
+		}
+
+		switch policy {
+		case DriftAlert:
+			applied = append(applied, prev...)
+		case DriftAdopt:
+			want = nil
+			for _, r := range lives[k] {
+				want = append(want, CloudflareRecord{
+					Name:     r.Name,
+					Type:     r.Type,
+					Content:  r.Content,
+					Proxied:  r.Proxied,
+					TTL:      r.TTL,
+					Priority: r.Priority,
+					Data:     r.Data,
+				})
+			}
+			adopted[k.String()] = Adoption{Desired: rendered, Records: want}
+			planned = append(planned, want...)
+			applied = append(applied, want...)
+		default:
+			planned = append(planned, want...)
+			applied = append(applied, want...)
+		}
+
+		var sig []string
+		for i := range drift {
+			drift[i].Policy = policy
+			sig = append(sig, drift[i].String())
+		}
+		reported[k.String()] = strings.Join(sig, "\n")
+		if st.Drift[k.String()] != reported[k.String()] {
+			events = append(events, drift...)
+		}
+	}
+
+	for _, e := range events {
+		log.Warn(e.String())
+		audit("drift", e)
+		s.notify(EventDrift, e.String(), e)
+	}
+
+	if err := s.state.Update(func(v *State) {
+		v.Adopted = adopted
+		v.Drift = reported
+	}); err != nil {
+		log.Error(err)
+	}
+
+	return planned, applied
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDriftCheckDue(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		config  string
+		applied *Applied
+		want    bool
+	}{
+		{name: "never applied", config: `{}`, want: true},
+		{name: "synced recently", config: `{}`, applied: &Applied{SyncedAt: now.Add(-time.Minute)}},
+		{name: "default interval", config: `{}`, applied: &Applied{SyncedAt: now.Add(-time.Hour)}, want: true},
+		{name: "checked recently", config: `{}`, applied: &Applied{SyncedAt: now.Add(-time.Hour), CheckedAt: now.Add(-time.Minute)}},
+		{name: "interval", config: `{"sync": {"drift_check": "1h"}}`, applied: &Applied{SyncedAt: now.Add(-30 * time.Minute)}},
+		{name: "disabled", config: `{"sync": {"drift_check": "-1s"}}`, applied: &Applied{SyncedAt: now.Add(-time.Hour)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadSettings(t, tt.config)
+			s := &Server{state: loadStore(filepath.Join(t.TempDir(), "state.json"))}
+			if err := s.state.Update(func(v *State) { v.Applied = tt.applied }); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.driftCheckDue(); got != tt.want {
+				t.Errorf("due = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// The gateway detectors ask the router for its WAN address by UPnP IGD, NAT-PMP (RFC 6886) or PCP (RFC 6887).
+
+// DoubleNATError reports that the WAN address of the router is not public,
+// so that there is another NAT between the router and the Internet.
+type DoubleNATError struct {
+	Addr netip.Addr
+}
+
+func (e *DoubleNATError) Error() string {
+	return fmt.Sprintf("double NAT: the WAN address of the router is %s", e.Addr)
+}
+
+func checkRouterAddr(addr netip.Addr) (string, error) {
+	if natted(addr) {
+		return "", &DoubleNATError{Addr: addr}
+	}
+	if reason := bogon(addr); reason != "" {
+		return "", fmt.Errorf("unexpected router WAN address %s: %s", addr, reason)
+	}
+	return addr.String(), nil
+}
+
+// DefaultGateway returns the IPv4 gateway of the default route, on the interface if it is not empty.
+func DefaultGateway(iface string) (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer f.Close()
+
+	const RTF_GATEWAY = 0x2
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) < 4 {
+			continue
+		}
+		if iface != "" && tokens[0] != iface {
+			continue
+		}
+		if tokens[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(tokens[3], 16, 32)
+		if err != nil || flags&RTF_GATEWAY == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(tokens[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		// little-endian
+		return netip.AddrFrom4([4]byte{b[3], b[2], b[1], b[0]}), nil
+	}
+
+	return netip.Addr{}, errors.New("default gateway not found")
+}
+
+func (w *wan) gatewayAddr() (netip.Addr, error) {
+	if w.gateway.IsValid() {
+		return w.gateway, nil
+	}
+	if v := settings.Value().Detect.Gateway; w == defaultWAN && v != "" {
+		addr, err := netip.ParseAddr(v)
+		if err != nil || !addr.Is4() {
+			return netip.Addr{}, fmt.Errorf("invalid gateway: %q", v)
+		}
+		return addr, nil
+	}
+	return DefaultGateway(w.iface)
+}
+
+type natpmpDetector struct{}
+
+func (natpmpDetector) Detect(ctx context.Context, w *wan, family string) (string, error) {
+	if family != "ip4" {
+		return "", ErrUnsupportedFamily
+	}
+
+	gw, err := w.gatewayAddr()
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := natpmpAddress(ctx, w, netip.AddrPortFrom(gw, gatewayPort))
+	if err != nil {
+		return "", fmt.Errorf("nat-pmp: %w", err)
+	}
+	return checkRouterAddr(addr)
+}
+
+// the port of NAT-PMP and PCP on the router
+const gatewayPort = 5351
+
+// natpmpAddress requests the external address of the NAT-PMP server.
+func natpmpAddress(ctx context.Context, w *wan, server netip.AddrPort) (netip.Addr, error) {
+	// version 0, opcode 0: external address request
+	res, err := gatewayExchange(ctx, w, server, []byte{0, 0}, func(b []byte) bool {
+		return len(b) >= 2 && b[0] == 0 && b[1] == 128
+	})
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return parseNATPMPResponse(res)
+}
+
+// parseNATPMPResponse returns the external address in the response of the external address request.
+func parseNATPMPResponse(b []byte) (netip.Addr, error) {
+	if len(b) < 4 || b[0] != 0 || b[1] != 128 {
+		return netip.Addr{}, errors.New("malformed response")
+	}
+	if code := binary.BigEndian.Uint16(b[2:]); code != 0 {
+		return netip.Addr{}, fmt.Errorf("result code %d", code)
+	}
+	if len(b) < 12 {
+		return netip.Addr{}, errors.New("malformed response")
+	}
+	return netip.AddrFrom4([4]byte(b[8:12])), nil
+}
+
+type pcpDetector struct{}
+
+// Detect requests a short-lived mapping of its own port by the PCP MAP opcode to learn the assigned
+// external address, the mapping is deleted afterwards.
+func (pcpDetector) Detect(ctx context.Context, w *wan, family string) (string, error) {
+	if family != "ip4" {
+		return "", ErrUnsupportedFamily
+	}
+
+	gw, err := w.gatewayAddr()
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := pcpAddress(ctx, w, netip.AddrPortFrom(gw, gatewayPort))
+	if err != nil {
+		return "", fmt.Errorf("pcp: %w", err)
+	}
+	return checkRouterAddr(addr)
+}
+
+// pcpMapRequest returns the MAP request of the UDP port of the client.
+func pcpMapRequest(local netip.AddrPort, nonce [12]byte, lifetime uint32) []byte {
+	b := make([]byte, 60)
+	b[0] = 2 // version
+	b[1] = 1 // MAP
+	binary.BigEndian.PutUint32(b[4:], lifetime)
+	client := local.Addr().As16()
+	copy(b[8:24], client[:])
+	copy(b[24:36], nonce[:])
+	b[36] = 17 // UDP
+	binary.BigEndian.PutUint16(b[40:], local.Port())
+	binary.BigEndian.PutUint16(b[42:], local.Port())
+	any4 := netip.IPv4Unspecified().As16()
+	copy(b[44:60], any4[:])
+	return b
+}
+
+// parsePCPResponse returns the assigned external address in the response of the MAP request.
+func parsePCPResponse(b []byte, nonce [12]byte) (netip.Addr, error) {
+	if len(b) < 60 || b[0] != 2 || b[1] != 0x81 || !bytes.Equal(b[24:36], nonce[:]) {
+		return netip.Addr{}, errors.New("malformed response")
+	}
+	if code := b[3]; code != 0 {
+		return netip.Addr{}, fmt.Errorf("result code %d", code)
+	}
+	return netip.AddrFrom16([16]byte(b[44:60])).Unmap(), nil
+}
+
+// pcpAddress requests a mapping of the PCP server and returns the assigned external address.
+func pcpAddress(ctx context.Context, w *wan, server netip.AddrPort) (netip.Addr, error) {
+	conn, err := w.DialContext(ctx, "udp4", server.String())
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	conn.Close()
+
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return netip.Addr{}, err
+	}
+
+	match := func(b []byte) bool {
+		return len(b) >= 36 && b[0] == 2 && b[1] == 0x81 && bytes.Equal(b[24:36], nonce[:])
+	}
+
+	res, err := gatewayExchange(ctx, w, server, pcpMapRequest(local, nonce, 30), match, local)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr, err := parsePCPResponse(res, nonce)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	// delete the mapping
+	_, _ = gatewayExchange(ctx, w, server, pcpMapRequest(local, nonce, 0), match, local)
+
+	return addr, nil
+}
+
+// gatewayExchange sends the request to the router and retransmits it with a doubled timeout each time,
+// starting from 250ms, until a matched response is received.
+func gatewayExchange(ctx context.Context, w *wan, server netip.AddrPort, req []byte, match func([]byte) bool, local ...netip.AddrPort) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+
+	d := &net.Dialer{Control: w.control}
+	if len(local) > 0 {
+		d.LocalAddr = net.UDPAddrFromAddrPort(local[0])
+	} else if w.addr4.IsValid() {
+		d.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(w.addr4, 0))
+	}
+
+	conn, err := d.DialContext(ctx, "udp4", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	buf := make([]byte, 1100)
+	rto := 250 * time.Millisecond
+
+	for {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		timeout := time.Now().Add(rto)
+		if timeout.After(deadline) {
+			timeout = deadline
+		}
+		conn.SetReadDeadline(timeout)
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var e net.Error
+				if errors.As(err, &e) && e.Timeout() && time.Now().Before(deadline) {
+					break
+				}
+				return nil, err
+			}
+			if match(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+
+		rto *= 2
+	}
+}
+
+type upnpDetector struct{}
+
+func (upnpDetector) Detect(ctx context.Context, w *wan, family string) (string, error) {
+	if family != "ip4" {
+		return "", ErrUnsupportedFamily
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 8*time.Second)
+	defer cancel()
+
+	locations, err := ssdpSearch(ctx, w)
+	if err != nil {
+		return "", fmt.Errorf("upnp: %w", err)
+	}
+
+	client := w.httpClient("tcp4")
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+
+	var errs []error
+	for _, location := range locations {
+		controlURL, service, err := igdControlURL(ctx, client, location)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s, err := igdExternalIPAddress(ctx, client, controlURL, service)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid external address: %q", s))
+			continue
+		}
+		return checkRouterAddr(addr)
+	}
+
+	return "", fmt.Errorf("upnp: %w", errors.Join(errs...))
+}
+
+// ssdpSearch returns the description URLs of the internet gateway devices. The search is sent to the
+// multicast group, and to the gateway directly if it is known.
+func ssdpSearch(ctx context.Context, w *wan) ([]string, error) {
+	lc := &net.ListenConfig{Control: w.control}
+	laddr := ":0"
+	if w.addr4.IsValid() {
+		laddr = net.JoinHostPort(w.addr4.String(), "0")
+	}
+
+	pc, err := lc.ListenPacket(ctx, "udp4", laddr)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	targets := []string{"239.255.255.250:1900"}
+	if gw, err := w.gatewayAddr(); err == nil {
+		targets = append(targets, netip.AddrPortFrom(gw, 1900).String())
+	}
+
+	for _, st := range []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	} {
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"ST: " + st + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+		for _, t := range targets {
+			addr, err := net.ResolveUDPAddr("udp4", t)
+			if err != nil {
+				continue
+			}
+			if _, err := pc.WriteTo([]byte(msg), addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	pc.SetReadDeadline(deadline)
+
+	var locations []string
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if loc := res.Header.Get("Location"); loc != "" && !slices.Contains(locations, loc) {
+			locations = append(locations, loc)
+		}
+	}
+
+	if len(locations) == 0 {
+		return nil, errors.New("internet gateway device not found")
+	}
+
+	return locations, nil
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+func (d *upnpDevice) find(prefixes ...string) (service, controlURL string) {
+	for _, p := range prefixes {
+		for _, s := range d.Services {
+			if strings.HasPrefix(s.ServiceType, p) {
+				return s.ServiceType, s.ControlURL
+			}
+		}
+	}
+	for i := range d.Devices {
+		if service, controlURL = d.Devices[i].find(prefixes...); service != "" {
+			return
+		}
+	}
+	return "", ""
+}
+
+func igdControlURL(ctx context.Context, client *http.Client, location string) (controlURL, service string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return "", "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&root); err != nil {
+		return "", "", err
+	}
+
+	service, u := root.Device.find(
+		"urn:schemas-upnp-org:service:WANIPConnection:",
+		"urn:schemas-upnp-org:service:WANPPPConnection:",
+	)
+	if service == "" {
+		return "", "", fmt.Errorf("%s: WAN connection service not found", location)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if v, err := url.Parse(root.URLBase); err == nil {
+			base = v
+		}
+	}
+	ref, err := url.Parse(u)
+	if err != nil {
+		return "", "", err
+	}
+	return base.ResolveReference(ref).String(), service, nil
+}
+
+func igdExternalIPAddress(ctx context.Context, client *http.Client, controlURL, service string) (string, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + service + `"></u:GetExternalIPAddress></s:Body>` +
+		`</s:Envelope>`
+
+	req, err := http.NewRequestWithContext(ctx, "POST", controlURL, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+service+`#GetExternalIPAddress"`)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: GetExternalIPAddress: %s", controlURL, res.Status)
+	}
+
+	var envelope struct {
+		Body struct {
+			Response struct {
+				Addr string `xml:"NewExternalIPAddress"`
+			} `xml:"GetExternalIPAddressResponse"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&envelope); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(envelope.Body.Response.Addr), nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func natpmpResponse(code uint16, addr netip.Addr) []byte {
+	b := make([]byte, 12)
+	b[1] = 128
+	binary.BigEndian.PutUint16(b[2:], code)
+	ip := addr.As4()
+	copy(b[8:], ip[:])
+	return b
+}
+
+// pcpResponse returns the response of the MAP request.
+func pcpResponse(req []byte, code byte, addr netip.Addr) []byte {
+	b := make([]byte, 60)
+	copy(b, req)
+	b[0] = 2
+	b[1] = 0x81
+	b[2] = 0
+	b[3] = code
+	ip := addr.As16()
+	copy(b[44:60], ip[:])
+	return b
+}
+
+func TestParseNATPMPResponse(t *testing.T) {
+	addr := netip.MustParseAddr("1.2.3.4")
+
+	tests := []struct {
+		name    string
+		b       []byte
+		want    netip.Addr
+		wantErr bool
+	}{
+		{name: "ok", b: natpmpResponse(0, addr), want: addr},
+		{name: "result code", b: natpmpResponse(3, addr), wantErr: true},
+		{name: "opcode", b: append([]byte{0, 129}, natpmpResponse(0, addr)[2:]...), wantErr: true},
+		{name: "version", b: append([]byte{2, 128}, natpmpResponse(0, addr)[2:]...), wantErr: true},
+		{name: "short", b: natpmpResponse(0, addr)[:8], wantErr: true},
+		{name: "short error", b: natpmpResponse(2, addr)[:4], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNATPMPResponse(tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePCPResponse(t *testing.T) {
+	nonce := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	req := pcpMapRequest(netip.MustParseAddrPort("192.168.1.2:4000"), nonce, 30)
+	v4 := netip.MustParseAddr("1.2.3.4")
+	v6 := netip.MustParseAddr("2001:4860::1")
+
+	other := pcpResponse(req, 0, v4)
+	other[24] ^= 0xff
+
+	tests := []struct {
+		name    string
+		b       []byte
+		want    netip.Addr
+		wantErr bool
+	}{
+		{name: "ipv4", b: pcpResponse(req, 0, v4), want: v4},
+		{name: "ipv6", b: pcpResponse(req, 0, v6), want: v6},
+		{name: "result code", b: pcpResponse(req, 8, v4), wantErr: true},
+		{name: "nonce", b: other, wantErr: true},
+		{name: "request", b: req, wantErr: true},
+		{name: "short", b: pcpResponse(req, 0, v4)[:44], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePCPResponse(tt.b, nonce)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayAddress(t *testing.T) {
+	addr := netip.MustParseAddr("1.2.3.4")
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, src, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			switch {
+			case n == 2 && buf[0] == 0 && buf[1] == 0:
+				pc.WriteTo(natpmpResponse(0, addr), src)
+			case n == 60 && buf[0] == 2 && buf[1] == 1:
+				pc.WriteTo(pcpResponse(buf[:n], 0, addr), src)
+			}
+		}
+	}()
+
+	server := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	got, err := natpmpAddress(context.Background(), &wan{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != addr {
+		t.Errorf("nat-pmp: got %s, want %s", got, addr)
+	}
+
+	got, err = pcpAddress(context.Background(), &wan{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != addr {
+		t.Errorf("pcp: got %s, want %s", got, addr)
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+const maxHealthHistory = 50
+
+type HealthEvent struct {
+	Time   time.Time `json:"time"`
+	Up     bool      `json:"up"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type HealthStatus struct {
+	Name      string        `json:"name"`
+	Up        bool          `json:"up"`
+	Failures  int           `json:"failures"`
+	Successes int           `json:"successes"`
+	LastCheck time.Time     `json:"last_check"`
+	LastError string        `json:"last_error,omitempty"`
+	History   []HealthEvent `json:"history"`
+}
+
+type healthCheck struct {
+	conf   settings.HealthCheck
+	wan    *wan
+	client *http.Client
+
+	mu     sync.RWMutex
+	status HealthStatus
+}
+
+func newHealthCheck(conf settings.HealthCheck, w *wan) (*healthCheck, error) {
+	switch conf.Type {
+	case "tcp", "http", "udp":
+	default:
+		return nil, fmt.Errorf("health check %s: unsupported type: %q", conf.Name, conf.Type)
+	}
+	if conf.Target == "" {
+		return nil, fmt.Errorf("health check %s: target is required", conf.Name)
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = zok.Duration(30 * time.Second)
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = zok.Duration(5 * time.Second)
+	}
+	if conf.Fall <= 0 {
+		conf.Fall = 3
+	}
+	if conf.Rise <= 0 {
+		conf.Rise = 2
+	}
+	client := w.httpClient("tcp")
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+	return &healthCheck{
+		conf:   conf,
+		wan:    w,
+		client: client,
+		status: HealthStatus{Name: conf.Name, Up: true, History: []HealthEvent{}},
+	}, nil
+}
+
+func (h *healthCheck) Up() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.status.Up
+}
+
+func (h *healthCheck) Status() HealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	v := h.status
+	v.History = append([]HealthEvent{}, h.status.History...)
+	return v
+}
+
+// update records the result of a probe and reports whether the state is changed.
+func (h *healthCheck) update(err error) (changed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &h.status
+	s.LastCheck = time.Now()
+
+	if err != nil {
+		s.LastError = err.Error()
+		s.Failures++
+		s.Successes = 0
+		if s.Up && s.Failures >= h.conf.Fall {
+			s.Up = false
+			changed = true
+		}
+	} else {
+		s.LastError = ""
+		s.Successes++
+		s.Failures = 0
+		if !s.Up && s.Successes >= h.conf.Rise {
+			s.Up = true
+			changed = true
+		}
+	}
+
+	if changed {
+		e := HealthEvent{Time: s.LastCheck, Up: s.Up}
+		if err != nil {
+			e.Reason = err.Error()
+		}
+		s.History = append(s.History, e)
+		if len(s.History) > maxHealthHistory {
+			s.History = s.History[len(s.History)-maxHealthHistory:]
+		}
+	}
+
+	return
+}
+
+func (h *healthCheck) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.conf.Timeout.Value())
+	defer cancel()
+
+	switch h.conf.Type {
+	case "tcp":
+		conn, err := h.wan.DialContext(ctx, "tcp", h.conf.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, "GET", h.conf.Target, nil)
+		if err != nil {
+			return err
+		}
+		res, err := h.client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if h.conf.Status != 0 {
+			if res.StatusCode != h.conf.Status {
+				return fmt.Errorf("unexpected status: %d", res.StatusCode)
+			}
+			return nil
+		}
+		if res.StatusCode < 200 || res.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status: %d", res.StatusCode)
+		}
+		return nil
+	default:
+		// the target is regarded as alive only if it replies, no ICMP is required.
+		conn, err := h.wan.DialContext(ctx, "udp", h.conf.Target)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		payload := h.conf.Send
+		if payload == "" {
+			payload = "\n"
+		}
+		if _, err := conn.Write([]byte(payload)); err != nil {
+			return err
+		}
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if h.conf.Expect != "" && !strings.Contains(string(buf[:n]), h.conf.Expect) {
+			return errors.New("unexpected response")
+		}
+		return nil
+	}
+}
+
+func (h *healthCheck) run(ctx context.Context, onChange func()) {
+	for {
+		err := h.probe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if h.update(err) {
+			if h.Up() {
+				log.Infof("health check %s: up", h.conf.Name)
+			} else {
+				log.Warnf("health check %s: down: %s", h.conf.Name, err)
+			}
+			onChange()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(h.conf.Interval.Value()):
+		}
+	}
+}
+
+func (s *Server) initHealthChecks() error {
+	s.health = map[string]*healthCheck{}
+	for _, conf := range settings.Value().HealthChecks {
+		if _, exists := s.health[conf.Name]; exists {
+			return fmt.Errorf("health check %s: duplicated", conf.Name)
+		}
+		w := defaultWAN
+		if conf.WAN != "" {
+			v, exists := s.wans[conf.WAN]
+			if !exists {
+				return fmt.Errorf("health check %s: wan %s: not found", conf.Name, conf.WAN)
+			}
+			w = v
+		}
+		h, err := newHealthCheck(conf, w)
+		if err != nil {
+			return err
+		}
+		s.health[conf.Name] = h
+	}
+	return nil
+}
+
+func (s *Server) healthCheck(ctx context.Context) {
+	for _, h := range s.health {
+		go h.run(ctx, s.trigger)
+	}
+}
+
+// healthy reports whether the named health check is up, it is true if the name is empty.
+func (s *Server) healthy(name string) (bool, error) {
+	if name == "" {
+		return true, nil
+	}
+	h, exists := s.health[name]
+	if !exists {
+		return false, fmt.Errorf("health check %s: not found", name)
+	}
+	return h.Up(), nil
+}
+
+func (s *Server) HealthStatus() []HealthStatus {
+	items := []HealthStatus{}
+	for _, conf := range settings.Value().HealthChecks {
+		if h, exists := s.health[conf.Name]; exists {
+			items = append(items, h.Status())
+		}
+	}
+	return items
+}
@@ -1,11 +1,12 @@
 package server
 
 import (
+	"context"
 	"net"
 )
 
-func OutboundIPv6() (string, error) {
-	conn, err := net.Dial("udp6", "[2606:4700:4700::1111]:53")
+func OutboundIPv6(ctx context.Context, w *wan) (string, error) {
+	conn, err := w.DialContext(ctx, "udp6", "[2606:4700:4700::1111]:53")
 	if err != nil {
 		return "", err
 	}
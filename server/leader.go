@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+const (
+	RoleStandalone = "standalone"
+	RoleLeader     = "leader"
+	RoleFollower   = "follower"
+)
+
+var ErrFollower = errors.New("not the leader")
+
+// elector elects the one of the instances which writes to the zone.
+type elector interface {
+	// acquire acquires or renews the leadership, and reports whether this instance is the leader.
+	acquire(ctx context.Context) (bool, error)
+	// release gives up the leadership.
+	release(ctx context.Context) error
+}
+
+func instanceID() string {
+	if v := settings.Value().Leader.ID; v != "" {
+		return v
+	}
+	name, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", name, os.Getpid())
+}
+
+func leaseTTL() time.Duration {
+	if v := settings.Value().Leader.TTL.Value(); v > 0 {
+		return v
+	}
+	return time.Minute
+}
+
+// newElector returns the elector of the instance, nil if it is disabled. An observe only instance never writes,
+// so it does not take part in the election, which would hold the lock or write the lease.
+func newElector(id string) (elector, error) {
+	v := settings.Value().Leader
+	if settings.Value().ObserveOnly {
+		return nil, nil
+	}
+	switch v.Method {
+	case "":
+		return nil, nil
+	case "file":
+		if v.Lock == "" {
+			return nil, errors.New("leader: lock is required")
+		}
+		return &fileElector{filename: v.Lock, id: id}, nil
+	case "txt":
+		if v.Name == "" {
+			return nil, errors.New("leader: name is required")
+		}
+		return &leaseElector{name: hostname(v.Name), id: id, ttl: leaseTTL()}, nil
+	}
+	return nil, fmt.Errorf("leader: unsupported method: %q", v.Method)
+}
+
+// fileElector holds an advisory lock of a file on the shared storage, which is released
+// by the system when the process exits.
+type fileElector struct {
+	filename string
+	id       string
+	file     *os.File
+}
+
+func (e *fileElector) acquire(context.Context) (bool, error) {
+	if e.file != nil {
+		return true, nil
+	}
+
+	f, err := os.OpenFile(e.filename, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// the holder is informative only
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(e.id+"\n"), 0)
+	}
+
+	e.file = f
+	return true, nil
+}
+
+func (e *fileElector) release(context.Context) error {
+	if e.file == nil {
+		return nil
+	}
+	f := e.file
+	e.file = nil
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return f.Close()
+}
+
+// leaseElector holds a lease stored as a TXT record in the zone, which is renewed before it expires.
+type leaseElector struct {
+	name string
+	id   string
+	ttl  time.Duration
+}
+
+type lease struct {
+	holder  string
+	expires time.Time
+}
+
+func parseLease(content string) (lease, bool) {
+	var v lease
+	for _, field := range strings.Split(unquote(content), ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "holder":
+			v.holder = value
+		case "expires":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return v, false
+			}
+			v.expires = time.Unix(n, 0)
+		}
+	}
+	return v, v.holder != ""
+}
+
+func (v lease) String() string {
+	return fmt.Sprintf("holder=%s;expires=%d", v.holder, v.expires.Unix())
+}
+
+func (e *leaseElector) records(ctx context.Context) ([]CloudflareRecord, error) {
+	var result struct {
+		Data []CloudflareRecord `json:"result"`
+	}
+	path := "/dns_records?type=TXT&name=" + url.QueryEscape(e.name)
+	if err := RequestCloudflare(ctx, "GET", path, nil, &result); err != nil {
+		return nil, err
+	}
+	// the record of the least id wins if more than one instance created it at once
+	slices.SortFunc(result.Data, func(a, b CloudflareRecord) int { return strings.Compare(a.ID, b.ID) })
+	return result.Data, nil
+}
+
+func (e *leaseElector) record() CloudflareRecord {
+	content := lease{holder: e.id, expires: time.Now().Add(e.ttl)}.String()
+	return CloudflareRecord{Name: e.name, Type: "TXT", Content: strconv.Quote(content), TTL: 60, Comment: ownerComment}
+}
+
+func (e *leaseElector) acquire(ctx context.Context) (bool, error) {
+	records, err := e.records(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if len(records) == 0 {
+		if err := addRecord(ctx, settings.Value().ZoneID, e.record()); err != nil {
+			return false, err
+		}
+		if records, err = e.records(ctx); err != nil {
+			return false, err
+		}
+		for _, r := range records[min(len(records), 1):] {
+			if v, _ := parseLease(r.Content); v.holder == e.id {
+				return false, deleteRecord(ctx, settings.Value().ZoneID, r.ID)
+			}
+		}
+	}
+
+	if len(records) == 0 {
+		return false, nil
+	}
+
+	current := records[0]
+	v, ok := parseLease(current.Content)
+	if ok && v.holder != e.id && time.Now().Before(v.expires) {
+		return false, nil
+	}
+
+	// renew the own lease or take over the expired one
+	b, err := json.Marshal(map[string]any{"content": e.record().Content})
+	if err != nil {
+		return false, err
+	}
+	if err := RequestCloudflare(ctx, "PATCH", "/dns_records/"+current.ID, bytes.NewReader(b), nil); err != nil {
+		return false, err
+	}
+
+	// another instance may take over the expired lease at the same time, the last write wins
+	if records, err = e.records(ctx); err != nil || len(records) == 0 {
+		return false, err
+	}
+	v, _ = parseLease(records[0].Content)
+	return v.holder == e.id, nil
+}
+
+func (e *leaseElector) release(ctx context.Context) error {
+	records, err := e.records(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if v, _ := parseLease(r.Content); v.holder == e.id {
+			if err := deleteRecord(ctx, settings.Value().ZoneID, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// leaseKey returns the key of the TXT record of the lease, which is never deleted by the reconciliation.
+func leaseKey() (recordKey, bool) {
+	v := settings.Value().Leader
+	if v.Method != "txt" || v.Name == "" {
+		return recordKey{}, false
+	}
+	return keyOf(v.Name, "TXT"), true
+}
+
+// withoutLease returns the records but the one of the lease, which is left to the elector.
+func withoutLease(records []CloudflareRecord) []CloudflareRecord {
+	k, ok := leaseKey()
+	if !ok {
+		return records
+	}
+	return slices.DeleteFunc(slices.Clone(records), func(r CloudflareRecord) bool { return keyOf(r.Name, r.Type) == k })
+}
+
+// role returns the role of the instance in the election.
+func (s *Server) role() string {
+	if s.elector == nil {
+		return RoleStandalone
+	}
+	if s.leader.Load() {
+		return RoleLeader
+	}
+	return RoleFollower
+}
+
+// elect acquires and renews the leadership until the context is done, then releases it.
+func (s *Server) elect(ctx context.Context) {
+	interval := leaseTTL() / 3
+
+	for {
+		leader, err := s.elector.acquire(ctx)
+		if err != nil {
+			log.Warn("leader:", err)
+			// the lease may expire while it can not be renewed
+			leader = false
+		}
+		if s.leader.Swap(leader) != leader {
+			if leader {
+				log.Info("leader: this instance is the leader")
+				s.trigger()
+			} else {
+				log.Info("leader: this instance is a follower")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			s.leader.Store(false)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := s.elector.release(ctx); err != nil {
+				log.Warn("leader:", err)
+			}
+			cancel()
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+// https://developers.cloudflare.com/api/resources/rules/subresources/lists/
+// https://developers.cloudflare.com/api/resources/firewall/subresources/access_rules/
+// https://developers.cloudflare.com/waf/custom-rules/create-api/
+
+const (
+	ListTypeIPList     = "ip_list"
+	ListTypeAccessRule = "access_rule"
+	ListTypeCustomRule = "custom_rule"
+)
+
+// The items of a list target are planned as the records of which the name is the one of
+// the target and the content is the address.
+const (
+	recordTypeIPList     = "IP_LIST"
+	recordTypeAccessRule = "ACCESS_RULE"
+	recordTypeCustomRule = "CUSTOM_RULE"
+)
+
+// listProvider returns the provider of the items of the list target.
+func listProvider(v settings.List, st *store) (Provider, error) {
+	switch v.Type {
+	case ListTypeIPList:
+		if v.Account == "" || v.Name == "" {
+			return nil, fmt.Errorf("list %s: account and name are required", v.Name)
+		}
+		return &ipListProvider{account: v.Account, name: v.Name}, nil
+	case ListTypeAccessRule:
+		if v.Name == "" {
+			return nil, errors.New("access rule: name is required")
+		}
+		mode := v.Mode
+		if mode == "" {
+			mode = "whitelist"
+		}
+		return &accessRuleProvider{name: v.Name, mode: mode}, nil
+	case ListTypeCustomRule:
+		if v.Name == "" {
+			return nil, errors.New("custom rule: name is required")
+		}
+		return &customRuleProvider{name: v.Name, state: st}, nil
+	}
+	return nil, fmt.Errorf("list %s: unsupported type: %q", v.Name, v.Type)
+}
+
+func listRecordType(typ string) string {
+	switch typ {
+	case ListTypeAccessRule:
+		return recordTypeAccessRule
+	case ListTypeCustomRule:
+		return recordTypeCustomRule
+	}
+	return recordTypeIPList
+}
+
+// ipListItem returns the item of the address in an IP List, which accepts the IPv6 prefixes
+// of /64 or shorter only.
+func ipListItem(s string) string {
+	if addr, err := netip.ParseAddr(s); err == nil && addr.Is6() && !addr.Is4In6() {
+		return netip.PrefixFrom(addr, 64).Masked().String()
+	}
+	if p, err := netip.ParsePrefix(s); err == nil && p.Addr().Is6() && p.Bits() > 64 {
+		return netip.PrefixFrom(p.Addr(), 64).Masked().String()
+	}
+	return s
+}
+
+// desiredList resolves the addresses of the list target, it returns false when any of them
+// can not be resolved yet, so that the items stay untouched.
+func desiredList(v settings.List, d *Discovery) ([]CloudflareRecord, bool) {
+	d, err := d.WAN(v.WAN)
+	if err != nil {
+		log.Warnf("list %s: %s", v.Name, err)
+		return nil, false
+	}
+
+	values := v.Contents
+	if len(values) == 0 {
+		values = []string{"{{.IPv4}}"}
+	}
+
+	var records []CloudflareRecord
+	for _, s := range values {
+		content, err := render(s, d)
+		if err != nil {
+			if !errors.Is(err, ErrAddrNotFound) {
+				log.Warnf("list %s: %s", v.Name, err)
+			}
+			return nil, false
+		}
+		if _, err := netip.ParseAddr(content); err != nil {
+			if _, err := netip.ParsePrefix(content); err != nil {
+				log.Warnf("list %s: invalid address: %q", v.Name, content)
+				return nil, false
+			}
+		}
+		if v.Type == ListTypeIPList {
+			content = ipListItem(content)
+		}
+		records = append(records, CloudflareRecord{Name: v.Name, Type: listRecordType(v.Type), Content: content})
+	}
+	return records, true
+}
+
+// desiredLists resolves the addresses of all the list targets, an unresolved target is left out.
+func desiredLists(d *Discovery) []CloudflareRecord {
+	var records []CloudflareRecord
+	for _, v := range settings.Value().Lists {
+		if items, ok := desiredList(v, d); ok {
+			records = append(records, items...)
+		}
+	}
+	return records
+}
+
+// syncLists replaces the managed items of the list targets with the current addresses.
+func (s *Server) syncLists(ctx context.Context, d *Discovery) error {
+	var errs []error
+	for _, v := range settings.Value().Lists {
+		desired, ok := desiredList(v, d)
+		if !ok {
+			continue
+		}
+
+		p, err := listProvider(v, s.state)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		live, err := p.Records(ctx, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			continue
+		}
+
+		if _, err := planRecords(live, desired, func(recordKey) bool { return true }).Apply(ctx, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ipListProvider writes the items of an account level IP List, of which the items are managed
+// when the comment is ownerComment.
+type ipListProvider struct {
+	account string
+	name    string
+	id      string
+}
+
+func (p *ipListProvider) String() string {
+	return "ip list " + p.name
+}
+
+func (p *ipListProvider) listID(ctx context.Context) (string, error) {
+	if p.id != "" {
+		return p.id, nil
+	}
+
+	var result struct {
+		Data []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			Kind string `json:"kind"`
+		} `json:"result"`
+	}
+	if err := RequestCloudflareAPI(ctx, "GET", "/accounts/"+p.account+"/rules/lists", nil, &result); err != nil {
+		return "", err
+	}
+
+	for _, v := range result.Data {
+		if v.Name == p.name {
+			if v.Kind != "ip" {
+				return "", fmt.Errorf("%s: not an ip list", p)
+			}
+			p.id = v.ID
+			return p.id, nil
+		}
+	}
+	return "", fmt.Errorf("%s: not found", p)
+}
+
+func (p *ipListProvider) Records(ctx context.Context, _ []recordKey) ([]CloudflareRecord, error) {
+	id, err := p.listID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []CloudflareRecord
+	cursor := ""
+	for {
+		var result struct {
+			Data []struct {
+				ID      string `json:"id"`
+				IP      string `json:"ip"`
+				Comment string `json:"comment"`
+			} `json:"result"`
+			ResultInfo struct {
+				Cursors struct {
+					After string `json:"after"`
+				} `json:"cursors"`
+			} `json:"result_info"`
+		}
+
+		path := fmt.Sprintf("/accounts/%s/rules/lists/%s/items?per_page=500", p.account, id)
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		if err := RequestCloudflareAPI(ctx, "GET", path, nil, &result); err != nil {
+			return nil, err
+		}
+
+		for _, v := range result.Data {
+			if v.Comment != ownerComment {
+				continue
+			}
+			records = append(records, CloudflareRecord{ID: v.ID, Name: p.name, Type: recordTypeIPList, Content: v.IP})
+		}
+
+		cursor = result.ResultInfo.Cursors.After
+		if cursor == "" {
+			return records, nil
+		}
+	}
+}
+
+func (p *ipListProvider) Create(ctx context.Context, r CloudflareRecord) error {
+	id, err := p.listID(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal([]map[string]string{{"ip": r.Content, "comment": ownerComment}})
+	if err != nil {
+		return err
+	}
+	return RequestCloudflareAPI(ctx, "POST", fmt.Sprintf("/accounts/%s/rules/lists/%s/items", p.account, id), bytes.NewReader(b), nil)
+}
+
+// Update adds the new address before the old one is deleted, so that the list never lacks the current one.
+func (p *ipListProvider) Update(ctx context.Context, from, to CloudflareRecord) error {
+	if err := p.Create(ctx, to); err != nil {
+		return err
+	}
+	return p.Delete(ctx, from)
+}
+
+func (p *ipListProvider) Delete(ctx context.Context, r CloudflareRecord) error {
+	id, err := p.listID(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(map[string]any{"items": []map[string]string{{"id": r.ID}}})
+	if err != nil {
+		return err
+	}
+	return RequestCloudflareAPI(ctx, "DELETE", fmt.Sprintf("/accounts/%s/rules/lists/%s/items", p.account, id), bytes.NewReader(b), nil)
+}
+
+// accessRuleProvider writes the IP Access rules of the zone, of which the rules are managed
+// when the notes are the ones of the target.
+type accessRuleProvider struct {
+	name string
+	mode string
+}
+
+func (p *accessRuleProvider) String() string {
+	return "access rule " + p.name
+}
+
+func (p *accessRuleProvider) notes() string {
+	return ownerComment + ": " + p.name
+}
+
+func (p *accessRuleProvider) Records(ctx context.Context, _ []recordKey) ([]CloudflareRecord, error) {
+	var records []CloudflareRecord
+	for page := 1; ; page++ {
+		var result struct {
+			Data []struct {
+				ID            string `json:"id"`
+				Notes         string `json:"notes"`
+				Configuration struct {
+					Target string `json:"target"`
+					Value  string `json:"value"`
+				} `json:"configuration"`
+			} `json:"result"`
+			ResultInfo struct {
+				TotalPages int `json:"total_pages"`
+			} `json:"result_info"`
+		}
+
+		path := fmt.Sprintf("/firewall/access_rules/rules?notes=%s&page=%d&per_page=100", url.QueryEscape(p.notes()), page)
+		if err := RequestCloudflare(ctx, "GET", path, nil, &result); err != nil {
+			return nil, err
+		}
+
+		for _, v := range result.Data {
+			if v.Notes != p.notes() || !strings.HasPrefix(v.Configuration.Target, "ip") {
+				continue
+			}
+			records = append(records, CloudflareRecord{ID: v.ID, Name: p.name, Type: recordTypeAccessRule, Content: v.Configuration.Value})
+		}
+
+		if page >= result.ResultInfo.TotalPages {
+			return records, nil
+		}
+	}
+}
+
+func (p *accessRuleProvider) Create(ctx context.Context, r CloudflareRecord) error {
+	target := "ip_range"
+	if addr, err := netip.ParseAddr(r.Content); err == nil {
+		target = "ip"
+		if addr.Is6() {
+			target = "ip6"
+		}
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"mode":          p.mode,
+		"notes":         p.notes(),
+		"configuration": map[string]string{"target": target, "value": r.Content},
+	})
+	if err != nil {
+		return err
+	}
+	return RequestCloudflare(ctx, "POST", "/firewall/access_rules/rules", bytes.NewReader(b), nil)
+}
+
+// Update creates the new rule before the old one is deleted, the address of a rule is immutable.
+func (p *accessRuleProvider) Update(ctx context.Context, from, to CloudflareRecord) error {
+	if err := p.Create(ctx, to); err != nil {
+		return err
+	}
+	return p.Delete(ctx, from)
+}
+
+func (p *accessRuleProvider) Delete(ctx context.Context, r CloudflareRecord) error {
+	return RequestCloudflare(ctx, "DELETE", "/firewall/access_rules/rules/"+r.ID, nil, nil)
+}
+
+// customRuleProvider writes the addresses of the set "ip.src in {...}" in the expression of a WAF custom rule
+// of the zone, of which the description is the name of the target. The addresses published by it are kept
+// in the state, only they are managed and the others of the set are left untouched.
+type customRuleProvider struct {
+	name  string
+	state *store
+}
+
+var ipSetExpr = regexp.MustCompile(`ip\.src\s+in\s+\{([^}]*)\}`)
+
+func (p *customRuleProvider) String() string {
+	return "custom rule " + p.name
+}
+
+// rule returns the id of the entrypoint ruleset of the custom rules and the rule of the target.
+func (p *customRuleProvider) rule(ctx context.Context) (string, map[string]any, error) {
+	var result struct {
+		Data struct {
+			ID    string           `json:"id"`
+			Rules []map[string]any `json:"rules"`
+		} `json:"result"`
+	}
+	if err := RequestCloudflare(ctx, "GET", "/rulesets/phases/http_request_firewall_custom/entrypoint", nil, &result); err != nil {
+		return "", nil, err
+	}
+	for _, r := range result.Data.Rules {
+		if r["description"] == p.name {
+			return result.Data.ID, r, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%s: not found", p)
+}
+
+// ipSet returns the addresses of the set in the expression, and the span of them.
+func (p *customRuleProvider) ipSet(rule map[string]any) (string, []string, []int, error) {
+	expr, _ := rule["expression"].(string)
+	loc := ipSetExpr.FindStringSubmatchIndex(expr)
+	if loc == nil {
+		return "", nil, nil, fmt.Errorf("%s: no ip.src in {...} in the expression", p)
+	}
+	return expr, strings.Fields(expr[loc[2]:loc[3]]), loc[2:4], nil
+}
+
+// owned returns the addresses published by the target.
+func (p *customRuleProvider) owned() []string {
+	return p.state.Load().CustomRules[p.name]
+}
+
+func (p *customRuleProvider) Records(ctx context.Context, _ []recordKey) ([]CloudflareRecord, error) {
+	_, rule, err := p.rule(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, addrs, _, err := p.ipSet(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := p.owned()
+	var records []CloudflareRecord
+	for _, addr := range addrs {
+		if slices.Contains(owned, addr) {
+			records = append(records, CloudflareRecord{Name: p.name, Type: recordTypeCustomRule, Content: addr})
+		}
+	}
+	return records, nil
+}
+
+// modify replaces the address from with the address to in the set, either of which is empty for
+// an addition or a removal. The rule is read again before every change. An address to which is
+// in the set already is taken over, it is removed with the published ones later.
+func (p *customRuleProvider) modify(ctx context.Context, from, to string) error {
+	ruleset, rule, err := p.rule(ctx)
+	if err != nil {
+		return err
+	}
+	expr, addrs, loc, err := p.ipSet(rule)
+	if err != nil {
+		return err
+	}
+
+	set := slices.Clone(addrs)
+	if from != "" {
+		set = slices.DeleteFunc(set, func(v string) bool { return v == from })
+	}
+	if to != "" && !slices.Contains(set, to) {
+		set = append(set, to)
+	}
+	if len(set) == 0 {
+		return fmt.Errorf("%s: the set can not be empty", p)
+	}
+
+	if !slices.Equal(set, addrs) {
+		rule["expression"] = expr[:loc[0]] + strings.Join(set, " ") + expr[loc[1]:]
+
+		id, _ := rule["id"].(string)
+		// the fields which are set by Cloudflare
+		delete(rule, "version")
+		delete(rule, "last_updated")
+
+		b, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		if err := RequestCloudflare(ctx, "PATCH", fmt.Sprintf("/rulesets/%s/rules/%s", ruleset, id), bytes.NewReader(b), nil); err != nil {
+			return err
+		}
+	}
+
+	return p.state.Update(func(st *State) {
+		owned := slices.DeleteFunc(slices.Clone(st.CustomRules[p.name]), func(v string) bool { return v == from || v == to })
+		if to != "" {
+			owned = append(owned, to)
+		}
+		if st.CustomRules == nil {
+			st.CustomRules = map[string][]string{}
+		}
+		if len(owned) == 0 {
+			delete(st.CustomRules, p.name)
+			return
+		}
+		st.CustomRules[p.name] = owned
+	})
+}
+
+func (p *customRuleProvider) Create(ctx context.Context, r CloudflareRecord) error {
+	return p.modify(ctx, "", r.Content)
+}
+
+func (p *customRuleProvider) Update(ctx context.Context, from, to CloudflareRecord) error {
+	return p.modify(ctx, from.Content, to.Content)
+}
+
+func (p *customRuleProvider) Delete(ctx context.Context, r CloudflareRecord) error {
+	return p.modify(ctx, r.Content, "")
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIPListItem(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.0/24", "192.0.2.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::/80", "2001:db8:1:2::/64"},
+		{"2001:db8::/48", "2001:db8::/48"},
+	}
+	for _, tt := range tests {
+		if got := ipListItem(tt.in); got != tt.want {
+			t.Errorf("ipListItem(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCustomRuleIPSet(t *testing.T) {
+	p := &customRuleProvider{name: "home"}
+	rule := map[string]any{"expression": `(http.host eq "example.com" and not ip.src in {192.0.2.1 2001:db8::/64})`}
+
+	expr, addrs, loc, err := p.ipSet(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"192.0.2.1", "2001:db8::/64"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("addrs = %q, want %q", addrs, want)
+	}
+	if got, want := expr[:loc[0]]+"198.51.100.1"+expr[loc[1]:], `(http.host eq "example.com" and not ip.src in {198.51.100.1})`; got != want {
+		t.Errorf("expression = %s, want %s", got, want)
+	}
+
+	if _, _, _, err := p.ipSet(map[string]any{"expression": `ip.src eq 192.0.2.1`}); err == nil {
+		t.Error("an expression without a set is accepted")
+	}
+}
+
+// fakeCloudflare routes the requests of the Cloudflare API to the handler until the test ends.
+func fakeCloudflare(t *testing.T, handler http.Handler) {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	prev := client
+	client = &http.Client{Transport: roundTripper(func(req *http.Request) (*http.Response, error) {
+		u, _ := url.Parse(ts.URL)
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	t.Cleanup(func() {
+		client = prev
+		ts.Close()
+	})
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCustomRuleProvider(t *testing.T) {
+	var mu sync.Mutex
+	expr := `(not ip.src in {10.0.0.1 1.2.3.4})`
+
+	fakeCloudflare(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/rulesets/phases/http_request_firewall_custom/entrypoint"):
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "result": map[string]any{
+				"id":    "rs",
+				"rules": []map[string]any{{"id": "r1", "description": "home", "expression": expr, "version": "1"}},
+			}})
+		case r.Method == "PATCH" && strings.HasSuffix(r.URL.Path, "/rulesets/rs/rules/r1"):
+			var rule map[string]any
+			json.NewDecoder(r.Body).Decode(&rule)
+			expr = rule["expression"].(string)
+			json.NewEncoder(w).Encode(map[string]any{"success": true})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	st := loadStore(filepath.Join(t.TempDir(), "state.json"))
+	if err := st.Update(func(v *State) { v.CustomRules = map[string][]string{"home": {"1.2.3.4"}} }); err != nil {
+		t.Fatal(err)
+	}
+	p := &customRuleProvider{name: "home", state: st}
+	ctx := context.Background()
+
+	apply := func(addrs ...string) {
+		t.Helper()
+		var desired []CloudflareRecord
+		for _, v := range addrs {
+			desired = append(desired, CloudflareRecord{Name: "home", Type: recordTypeCustomRule, Content: v})
+		}
+		live, err := p.Records(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := planRecords(live, desired, func(recordKey) bool { return true }).Apply(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		addrs []string
+		expr  string
+		owned []string
+	}{
+		// the address of the operator is kept
+		{[]string{"5.6.7.8"}, `(not ip.src in {10.0.0.1 5.6.7.8})`, []string{"5.6.7.8"}},
+		// an address in the set already is taken over
+		{[]string{"5.6.7.8", "10.0.0.1"}, `(not ip.src in {10.0.0.1 5.6.7.8})`, []string{"5.6.7.8", "10.0.0.1"}},
+	}
+
+	for i, tt := range tests {
+		apply(tt.addrs...)
+		if expr != tt.expr {
+			t.Errorf("%d: expression = %s, want %s", i, expr, tt.expr)
+		}
+		if got := st.Load().CustomRules["home"]; !reflect.DeepEqual(got, tt.owned) {
+			t.Errorf("%d: owned = %q, want %q", i, got, tt.owned)
+		}
+	}
+
+	// the last address of the set is not removed
+	live, err := p.Records(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Delete(ctx, live[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Delete(ctx, live[1]); err == nil {
+		t.Errorf("the set is emptied: %s", expr)
+	}
+}
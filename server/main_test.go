@@ -0,0 +1,20 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+func TestMain(m *testing.M) {
+	// the default settings, no config file is read
+	os.Setenv("CONFIG", filepath.Join(os.TempDir(), "cloudflare-ddns-test-none.json"))
+	settings.Load()
+	log.Open(log.Options{})
+	code := m.Run()
+	log.Close()
+	os.Exit(code)
+}
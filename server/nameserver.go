@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func getZone(ctx context.Context) (*Zone, error) {
+	var result struct {
+		Data Zone `json:"result"`
+	}
+	if err := RequestCloudflare(ctx, "GET", "", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result.Data, nil
+}
+
+// zone returns the zone, which is cached in the state.
+func (s *Server) zone(ctx context.Context) (*Zone, error) {
+	if v := s.state.Load().Zone; v != nil && v.ID == settings.Value().ZoneID {
+		return v, nil
+	}
+	v, err := getZone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.state.Update(func(st *State) { st.Zone = v }); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"TXT":   dnsmessage.TypeTXT,
+	"MX":    dnsmessage.TypeMX,
+}
+
+// verifiable reports whether the record served by the nameservers is comparable with the desired one,
+// a proxied record is served with the addresses of Cloudflare.
+func verifiable(r CloudflareRecord) bool {
+	if r.Proxied {
+		return false
+	}
+	_, ok := dnsTypes[r.Type]
+	return ok
+}
+
+// nsValue returns the record data in the form of the answer of lookupAuthoritative.
+func nsValue(r CloudflareRecord) string {
+	switch r.Type {
+	case "A", "AAAA":
+		if addr, err := netip.ParseAddr(r.Content); err == nil {
+			return addr.String()
+		}
+	case "MX":
+		var p uint16
+		if r.Priority != nil {
+			p = *r.Priority
+		}
+		return fmt.Sprintf("%d %s", p, hostname(r.Content))
+	}
+	return normalizeContent(r.Type, r.Content)
+}
+
+// lookupAuthoritative queries the nameservers in order for the records of the name without recursion,
+// the first answer is returned. A name which does not exist has no value.
+func lookupAuthoritative(ctx context.Context, nameservers []string, name, typ string) ([]string, error) {
+	var errs []error
+	for _, ns := range nameservers {
+		values, err := lookupNameServer(ctx, ns, name, typ)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return values, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// lookupNameServer queries the nameserver for the records of the name without recursion.
+// A name which does not exist has no value.
+func lookupNameServer(ctx context.Context, ns string, name, typ string) ([]string, error) {
+	t, ok := dnsTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("dns: unsupported type: %s", typ)
+	}
+
+	n, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			{Name: n, Type: t, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	res, err := DNSExchange(ctx, defaultWAN, "udp", ns, msg)
+	if err != nil {
+		return nil, fmt.Errorf("dns: @%s %s %s: %w", ns, name, typ, err)
+	}
+
+	switch res.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("dns: @%s %s %s: %s", ns, name, typ, res.RCode)
+	}
+
+	var values []string
+	for _, a := range res.Answers {
+		if a.Header.Type != t {
+			continue
+		}
+		switch v := a.Body.(type) {
+		case *dnsmessage.AResource:
+			values = append(values, netip.AddrFrom4(v.A).String())
+		case *dnsmessage.AAAAResource:
+			values = append(values, netip.AddrFrom16(v.AAAA).String())
+		case *dnsmessage.CNAMEResource:
+			values = append(values, hostname(v.CNAME.String()))
+		case *dnsmessage.TXTResource:
+			values = append(values, dnsTXT(v))
+		case *dnsmessage.MXResource:
+			values = append(values, fmt.Sprintf("%d %s", v.Pref, hostname(v.MX.String())))
+		}
+	}
+	return values, nil
+}
+
+// verifyRecords reports an error if the records served by the nameservers differ from the desired ones.
+func verifyRecords(ctx context.Context, nameservers []string, desired []CloudflareRecord) error {
+	wants := map[recordKey][]string{}
+	for _, r := range desired {
+		if verifiable(r) {
+			k := keyOf(r.Name, r.Type)
+			wants[k] = append(wants[k], nsValue(r))
+		}
+	}
+
+	for k, want := range wants {
+		got, err := lookupAuthoritative(ctx, nameservers, k.Name, k.Type)
+		if err != nil {
+			return err
+		}
+		slices.Sort(want)
+		slices.Sort(got)
+		if !slices.Equal(slices.Compact(want), slices.Compact(got)) {
+			return fmt.Errorf("nameserver: %s %s: served %s, want %s", k.Name, k.Type, strings.Join(got, ", "), strings.Join(want, ", "))
+		}
+	}
+
+	return nil
+}
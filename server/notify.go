@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+const (
+	EventAddress      = "address"
+	EventRecordCreate = "record.create"
+	EventRecordUpdate = "record.update"
+	EventRecordDelete = "record.delete"
+	EventFailure      = "failure"
+	EventDrift        = "drift"
+)
+
+var eventTitles = map[string]string{
+	EventAddress:      "address changed",
+	EventRecordCreate: "record created",
+	EventRecordUpdate: "record updated",
+	EventRecordDelete: "record deleted",
+	EventFailure:      "run failed",
+	EventDrift:        "drift detected",
+	EventDigest:       "daily digest",
+}
+
+// Event is a notification of what happens in the reconciliation.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+	Data    any       `json:"data,omitempty"`
+}
+
+// notifier delivers the events to a destination.
+type notifier interface {
+	String() string
+	// accepts reports whether the events of the type are delivered.
+	accepts(typ string) bool
+	send(ctx context.Context, e Event) error
+}
+
+func notifiers() (map[string]notifier, error) {
+	m := map[string]notifier{}
+	var errs []error
+	if v := settings.Value().Notify.SMTP; v.Host != "" {
+		n, err := newMailer(v)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			m[n.String()] = n
+		}
+	}
+	for _, v := range settings.Value().Notify.Webhooks {
+		n, err := newWebhook(v)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, exists := m[n.String()]; exists {
+			errs = append(errs, fmt.Errorf("%s: duplicated", n))
+			continue
+		}
+		m[n.String()] = n
+	}
+	return m, errors.Join(errs...)
+}
+
+// acceptsEvent reports whether the type is in the events, all but the digest if empty.
+func acceptsEvent(events []string, typ string) bool {
+	if len(events) == 0 {
+		return typ != EventDigest
+	}
+	return slices.Contains(events, typ)
+}
+
+// outboxEntry is an event which is not delivered to the notifier yet.
+type outboxEntry struct {
+	Notifier string    `json:"notifier"`
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func outboxDir() string {
+	return filepath.Join(settings.Value().DataDirectory, "outbox")
+}
+
+func writeOutbox(filename string, v *outboxEntry) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return zok.WriteFile(filename, b, 0o600)
+}
+
+// notify queues the event in the outbox of every notifier which accepts it, and collects it for the digest.
+func (s *Server) notify(typ, message string, data any) {
+	var id [4]byte
+	rand.Read(id[:])
+	now := time.Now().UTC()
+	e := Event{
+		ID:      now.Format("20060102T150405.000000Z") + "-" + hex.EncodeToString(id[:]),
+		Type:    typ,
+		Time:    now,
+		Title:   "cloudflare-ddns: " + eventTitles[typ],
+		Message: message,
+		Data:    data,
+	}
+
+	collectEvent(e)
+	if len(s.notifiers) == 0 {
+		return
+	}
+
+	for name, n := range s.notifiers {
+		if !n.accepts(typ) {
+			continue
+		}
+		filename := filepath.Join(outboxDir(), e.ID+"."+hex.EncodeToString([]byte(name))+".json")
+		if err := writeOutbox(filename, &outboxEntry{Notifier: name, Event: e, Next: now}); err != nil {
+			log.Error(fmt.Errorf("notify: %w", err))
+		}
+	}
+
+	select {
+	case s.outbox <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the events in the outbox until the context is done. A failed delivery is retried
+// with a backoff, and dropped after the attempts.
+func (s *Server) deliver(ctx context.Context) {
+	for {
+		next := s.flushOutbox(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.outbox:
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// flushOutbox sends the due events in order, and returns the time of the next attempt.
+func (s *Server) flushOutbox(ctx context.Context) time.Time {
+	next := time.Now().Add(time.Minute)
+
+	entries, err := os.ReadDir(outboxDir())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Error(fmt.Errorf("notify: %w", err))
+		}
+		return next
+	}
+
+	attempts := settings.Value().Notify.Retries
+	if attempts <= 0 {
+		attempts = 10
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		filename := filepath.Join(outboxDir(), entry.Name())
+
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		var v outboxEntry
+		if err := json.Unmarshal(b, &v); err != nil {
+			log.Warn("notify:", entry.Name(), err)
+			os.Remove(filename)
+			continue
+		}
+
+		n, exists := s.notifiers[v.Notifier]
+		if !exists {
+			log.Warnf("notify %s: not configured, drop event %s", v.Notifier, v.Event.ID)
+			os.Remove(filename)
+			continue
+		}
+
+		if time.Now().Before(v.Next) {
+			if v.Next.Before(next) {
+				next = v.Next
+			}
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return next
+		}
+
+		err = n.send(ctx, v.Event)
+		if err == nil {
+			log.Debugf("notify %s: %s sent", n, v.Event.ID)
+			os.Remove(filename)
+			continue
+		}
+
+		v.Attempts++
+		v.Error = err.Error()
+		if v.Attempts >= attempts {
+			log.Error(fmt.Errorf("notify %s: drop event %s after %d attempts: %w", n, v.Event.ID, v.Attempts, err))
+			audit("notify drop", v)
+			os.Remove(filename)
+			continue
+		}
+
+		v.Next = time.Now().Add(min(30*time.Second<<(v.Attempts-1), time.Hour))
+		log.Warnf("notify %s: %s, retry at %s", n, err, v.Next.Format(time.RFC3339))
+		if err := writeOutbox(filename, &v); err != nil {
+			log.Error(fmt.Errorf("notify: %w", err))
+		}
+		if v.Next.Before(next) {
+			next = v.Next
+		}
+	}
+
+	return next
+}
+
+// notifyAddress queues the event of a published address change.
+func (s *Server) notifyAddress(p PendingAddr, from string) {
+	s.notify(EventAddress, fmt.Sprintf("%s -> %s (wan: %s, %s)", from, p.Published, p.WAN, p.Family), map[string]string{
+		"wan":    p.WAN,
+		"family": p.Family,
+		"from":   from,
+		"to":     p.Published,
+	})
+}
+
+// notifyChanges queues the events of the applied changes.
+func (s *Server) notifyChanges(changes []Change) {
+	for _, c := range changes {
+		switch c.Action {
+		case ActionCreate:
+			s.notify(EventRecordCreate, c.String(), c)
+		case ActionUpdate:
+			s.notify(EventRecordUpdate, c.String(), c)
+		case ActionDelete:
+			s.notify(EventRecordDelete, c.String(), c)
+		}
+	}
+}
+
+// notifyFailure queues the event of a failed run, unless it is the same as the last one.
+func (s *Server) notifyFailure(err error) {
+	if err == nil {
+		s.failure = ""
+		return
+	}
+	collectDigest(func(d *Digest) { d.Errors++ })
+	if s.failure == err.Error() {
+		return
+	}
+	s.failure = err.Error()
+	s.notify(EventFailure, err.Error(), nil)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+var (
+	ErrPaused      = errors.New("reconciliation is paused")
+	ErrObserveOnly = errors.New("observe only")
+)
+
+// Pause stops the writes to the DNS providers, while the discovery and the drift detection keep running.
+type Pause struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// writable returns the reason why the records can not be written, nil if they can.
+func writable(st State) error {
+	if settings.Value().ObserveOnly {
+		return ErrObserveOnly
+	}
+	if st.Paused != nil {
+		return ErrPaused
+	}
+	return nil
+}
+
+// writable returns the reason why the records can not be written by the instance, nil if they can.
+func (s *Server) writable() error {
+	if err := writable(s.state.Load()); err != nil {
+		return err
+	}
+	if s.role() == RoleFollower {
+		return ErrFollower
+	}
+	return nil
+}
+
+// skipPlan logs the changes which are not applied because of the reason.
+func skipPlan(plan *Plan, reason error) {
+	for _, c := range plan.Changes {
+		log.Infof("%s, skip: %s", reason, c)
+	}
+}
+
+func (s *Server) Pause(c *gin.Context) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			AbortBadRequestError(c, err)
+			return
+		}
+	}
+
+	v := &Pause{Reason: body.Reason, Since: time.Now()}
+	if err := s.state.Update(func(st *State) {
+		if st.Paused == nil {
+			st.Paused = v
+		}
+		v = st.Paused
+	}); err != nil {
+		Abort500(c, err)
+		return
+	}
+
+	log.Info("reconciliation paused:", v.Reason)
+	audit("pause", v)
+	c.JSON(http.StatusOK, v)
+}
+
+func (s *Server) Resume(c *gin.Context) {
+	if err := s.state.Update(func(st *State) { st.Paused = nil }); err != nil {
+		Abort500(c, err)
+		return
+	}
+
+	log.Info("reconciliation resumed")
+	audit("resume", nil)
+	s.trigger()
+	c.JSON(http.StatusOK, struct{}{})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+type Change struct {
+	Action Action            `json:"action"`
+	From   *CloudflareRecord `json:"from,omitempty"`
+	To     *CloudflareRecord `json:"to,omitempty"`
+}
+
+func (c Change) String() string {
+	switch c.Action {
+	case ActionCreate:
+		return "ADD record: " + c.To.String()
+	case ActionUpdate:
+		return "PATCH record: " + c.To.String()
+	default:
+		return "DELETE record: " + c.From.String()
+	}
+}
+
+type Plan struct {
+	Changes []Change `json:"changes"`
+}
+
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+func (p *Plan) create(to CloudflareRecord) {
+	p.Changes = append(p.Changes, Change{Action: ActionCreate, To: &to})
+}
+
+func (p *Plan) update(from, to CloudflareRecord) {
+	p.Changes = append(p.Changes, Change{Action: ActionUpdate, From: &from, To: &to})
+}
+
+func (p *Plan) delete(from CloudflareRecord) {
+	p.Changes = append(p.Changes, Change{Action: ActionDelete, From: &from})
+}
+
+// planRecords computes the changes that converge the live records to the desired ones.
+//
+// The desired records of a name and type are handled as a set: values already published are kept,
+// surplus records are reused for missing values and the rest are deleted, so a set is converged
+// with as few API calls as possible. Live records of which the name and type is not managed are deleted.
+func planRecords(live []CloudflareRecord, desired []CloudflareRecord, managed func(recordKey) bool) *Plan {
+	var keys []recordKey
+	wants := map[recordKey][]CloudflareRecord{}
+	for _, r := range desired {
+		k := keyOf(r.Name, r.Type)
+		if _, exists := wants[k]; !exists {
+			keys = append(keys, k)
+		}
+		wants[k] = append(wants[k], r)
+	}
+
+	lives := map[recordKey][]CloudflareRecord{}
+	for _, r := range live {
+		k := keyOf(r.Name, r.Type)
+		lives[k] = append(lives[k], r)
+	}
+
+	p := &Plan{}
+
+	for _, k := range keys {
+		var missing []CloudflareRecord
+		extra := lives[k]
+
+		for _, want := range wants[k] {
+			i := -1
+			for j, r := range extra {
+				if sameValue(r, want) {
+					i = j
+					break
+				}
+			}
+
+			if i < 0 {
+				missing = append(missing, want)
+				continue
+			}
+
+			r := extra[i]
+			extra = append(extra[:i:i], extra[i+1:]...)
+			if !sameRecord(r, want) {
+				p.update(r, want)
+			}
+		}
+
+		for len(missing) > 0 && len(extra) > 0 {
+			p.update(extra[0], missing[0])
+			missing, extra = missing[1:], extra[1:]
+		}
+
+		for _, want := range missing {
+			p.create(want)
+		}
+
+		for _, r := range extra {
+			p.delete(r)
+		}
+	}
+
+	for _, r := range live {
+		k := keyOf(r.Name, r.Type)
+		if _, exists := wants[k]; exists || managed(k) {
+			continue
+		}
+		p.delete(r)
+	}
+
+	return p
+}
+
+// Apply executes the changes by the provider and returns the succeeded ones, a failure does not stop the others.
+func (p *Plan) Apply(ctx context.Context, provider Provider) ([]Change, error) {
+	var applied []Change
+	var errs []error
+	for _, c := range p.Changes {
+		var err error
+		switch c.Action {
+		case ActionCreate:
+			err = provider.Create(ctx, *c.To)
+		case ActionUpdate:
+			err = provider.Update(ctx, *c.From, *c.To)
+		case ActionDelete:
+			err = provider.Delete(ctx, *c.From)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if provider == cloudflare {
+			log.Info(c.String())
+		} else {
+			log.Infof("%s: %s", provider, c)
+		}
+		applied = append(applied, c)
+	}
+	return applied, errors.Join(errs...)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+// changeSummary returns the action, the id of the live record and the desired content of the change.
+func changeSummary(c Change) string {
+	s := string(c.Action)
+	if c.From != nil {
+		s += " " + c.From.ID
+	}
+	if c.To != nil {
+		s += " " + c.To.Content
+	}
+	return s
+}
+
+func TestPlanRecords(t *testing.T) {
+	a := func(id, name, content string) CloudflareRecord {
+		return CloudflareRecord{ID: id, Name: name, Type: "A", Content: content, TTL: 1}
+	}
+	managed := func(k recordKey) bool { return k.Name == "kept.example.com" }
+
+	tests := []struct {
+		name    string
+		live    []CloudflareRecord
+		desired []CloudflareRecord
+		want    []string
+	}{
+		{
+			name:    "create",
+			desired: []CloudflareRecord{a("", "a.example.com", "192.0.2.1")},
+			want:    []string{"create 192.0.2.1"},
+		},
+		{
+			name:    "unchanged",
+			live:    []CloudflareRecord{a("1", "a.example.com", "192.0.2.1")},
+			desired: []CloudflareRecord{a("", "A.example.com.", "192.0.2.1")},
+		},
+		{
+			name:    "content",
+			live:    []CloudflareRecord{a("1", "a.example.com", "192.0.2.1")},
+			desired: []CloudflareRecord{a("", "a.example.com", "192.0.2.2")},
+			want:    []string{"update 1 192.0.2.2"},
+		},
+		{
+			name: "proxied",
+			live: []CloudflareRecord{a("1", "a.example.com", "192.0.2.1")},
+			desired: []CloudflareRecord{
+				{Name: "a.example.com", Type: "A", Content: "192.0.2.1", TTL: 1, Proxied: true},
+			},
+			want: []string{"update 1 192.0.2.1"},
+		},
+		{
+			name: "set keeps the published values",
+			live: []CloudflareRecord{
+				a("1", "a.example.com", "192.0.2.1"),
+				a("2", "a.example.com", "192.0.2.2"),
+			},
+			desired: []CloudflareRecord{
+				a("", "a.example.com", "192.0.2.2"),
+				a("", "a.example.com", "192.0.2.3"),
+			},
+			want: []string{"update 1 192.0.2.3"},
+		},
+		{
+			name: "set grows",
+			live: []CloudflareRecord{a("1", "a.example.com", "192.0.2.1")},
+			desired: []CloudflareRecord{
+				a("", "a.example.com", "192.0.2.1"),
+				a("", "a.example.com", "192.0.2.2"),
+			},
+			want: []string{"create 192.0.2.2"},
+		},
+		{
+			name: "set shrinks",
+			live: []CloudflareRecord{
+				a("1", "a.example.com", "192.0.2.1"),
+				a("2", "a.example.com", "192.0.2.2"),
+			},
+			desired: []CloudflareRecord{a("", "a.example.com", "192.0.2.2")},
+			want:    []string{"delete 1"},
+		},
+		{
+			name: "type is a separate set",
+			live: []CloudflareRecord{a("1", "a.example.com", "192.0.2.1")},
+			desired: []CloudflareRecord{
+				a("", "a.example.com", "192.0.2.1"),
+				{Name: "a.example.com", Type: "AAAA", Content: "2001:db8::1", TTL: 1},
+			},
+			want: []string{"create 2001:db8::1"},
+		},
+		{
+			name: "unmanaged",
+			live: []CloudflareRecord{
+				a("1", "a.example.com", "192.0.2.1"),
+				a("2", "old.example.com", "192.0.2.1"),
+				a("3", "kept.example.com", "192.0.2.1"),
+			},
+			desired: []CloudflareRecord{a("", "a.example.com", "192.0.2.1")},
+			want:    []string{"delete 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range planRecords(tt.live, tt.desired, managed).Changes {
+				got = append(got, changeSummary(c))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+const (
+	PropagationPending    = "pending"
+	PropagationVisible    = "visible"
+	PropagationNotVisible = "applied but not visible"
+)
+
+// Propagation is the result of waiting for the authoritative nameservers to serve an applied record.
+type Propagation struct {
+	Record    string       `json:"record"`
+	Status    string       `json:"status"`
+	AppliedAt time.Time    `json:"applied_at"`
+	Latency   zok.Duration `json:"latency,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+const maxPropagations = 50
+
+func (s *status) addPropagation(record string) *Propagation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := &Propagation{Record: record, Status: PropagationPending, AppliedAt: time.Now()}
+	s.propagation = append(s.propagation, p)
+	if len(s.propagation) > maxPropagations {
+		s.propagation = s.propagation[len(s.propagation)-maxPropagations:]
+	}
+	return p
+}
+
+func (s *status) setPropagation(p *Propagation, status string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.Status = status
+	if status == PropagationVisible {
+		p.Latency = zok.Duration(time.Since(p.AppliedAt).Round(time.Millisecond))
+	}
+	if err != nil {
+		p.Error = err.Error()
+	}
+}
+
+// verifyPropagation waits in background for the created and updated records to be served by
+// all the authoritative nameservers of the zone.
+func (s *Server) verifyPropagation(ctx context.Context, applied []Change) {
+	var records []CloudflareRecord
+	for _, c := range applied {
+		if c.To != nil && verifiable(*c.To) {
+			records = append(records, *c.To)
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	zone, err := s.zone(ctx)
+	if err != nil {
+		log.Warn("propagation:", err)
+		return
+	}
+
+	timeout := settings.Value().Sync.PropagationTimeout.Value()
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+
+	for _, r := range records {
+		p := s.status.addPropagation(r.String())
+		go s.waitVisible(ctx, zone.NameServers, r, p, timeout)
+	}
+}
+
+// waitVisible waits for every nameserver of the zone to serve the record, a resolver may query any of them.
+func (s *Server) waitVisible(ctx context.Context, nameservers []string, r CloudflareRecord, p *Propagation, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if len(nameservers) == 0 {
+		s.status.setPropagation(p, PropagationNotVisible, errors.New("propagation: no nameserver"))
+		return
+	}
+
+	want := nsValue(r)
+
+	// the nameservers which do not serve the record yet
+	pending := slices.Clone(nameservers)
+	var err error
+	for {
+		var errs []error
+		pending = slices.DeleteFunc(pending, func(ns string) bool {
+			values, err := lookupNameServer(ctx, ns, r.Name, r.Type)
+			if err != nil {
+				errs = append(errs, err)
+				return false
+			}
+			return slices.Contains(values, want)
+		})
+		if len(pending) == 0 {
+			s.status.setPropagation(p, PropagationVisible, nil)
+			log.Infof("propagation: %s is visible after %s", r, time.Since(p.AppliedAt).Round(time.Millisecond))
+			return
+		}
+		err = errors.Join(errs...)
+
+		select {
+		case <-ctx.Done():
+			if err == nil {
+				err = fmt.Errorf("propagation: not served by %s", strings.Join(pending, ", "))
+			}
+			s.status.setPropagation(p, PropagationNotVisible, err)
+			log.Warnf("propagation: %s is applied but not visible after %s", r, timeout)
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveNameServer serves the records on a local udp address until the test ends.
+func serveNameServer(t *testing.T, records ...CloudflareRecord) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		pc.Close()
+	})
+
+	r := &responder{ttl: 60, records: groupRecords(records), names: map[string]bool{}}
+	for _, v := range records {
+		r.names[hostname(v.Name)] = true
+	}
+	go r.serveUDP(ctx, pc)
+	return pc.LocalAddr().String()
+}
+
+func TestWaitVisible(t *testing.T) {
+	record := CloudflareRecord{Name: "a.example.com", Type: "A", Content: "192.0.2.2"}
+	old := CloudflareRecord{Name: "a.example.com", Type: "A", Content: "192.0.2.1"}
+
+	tests := []struct {
+		name        string
+		nameservers []string
+		want        string
+	}{
+		{"all", []string{serveNameServer(t, record), serveNameServer(t, record)}, PropagationVisible},
+		{"one stale", []string{serveNameServer(t, record), serveNameServer(t, old)}, PropagationNotVisible},
+		{"none", nil, PropagationNotVisible},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{status: &status{}}
+			p := s.status.addPropagation(record.String())
+			s.waitVisible(context.Background(), tt.nameservers, record, p, time.Second)
+			if p.Status != tt.want {
+				t.Errorf("status = %q, want %q (error: %s)", p.Status, tt.want, p.Error)
+			}
+		})
+	}
+}
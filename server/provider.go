@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// Provider is the DNS service to which the records are written.
+type Provider interface {
+	// Records returns the live records of the names and types.
+	Records(ctx context.Context, keys []recordKey) ([]CloudflareRecord, error)
+	Create(ctx context.Context, r CloudflareRecord) error
+	Update(ctx context.Context, from, to CloudflareRecord) error
+	Delete(ctx context.Context, r CloudflareRecord) error
+}
+
+// cloudflareProvider writes the records to a zone at Cloudflare, the configured one if empty.
+type cloudflareProvider struct {
+	zone string
+}
+
+var cloudflare Provider = cloudflareProvider{}
+
+func (p cloudflareProvider) zoneID() string {
+	if p.zone == "" {
+		return settings.Value().ZoneID
+	}
+	return p.zone
+}
+
+func (p cloudflareProvider) String() string {
+	if p.zone == "" {
+		return "cloudflare"
+	}
+	return "cloudflare " + p.zone
+}
+
+// Records returns all the records of the zone, regardless of the keys.
+func (p cloudflareProvider) Records(ctx context.Context, _ []recordKey) ([]CloudflareRecord, error) {
+	return getZoneRecords(ctx, p.zoneID())
+}
+
+func (p cloudflareProvider) Create(ctx context.Context, r CloudflareRecord) error {
+	return addRecord(ctx, p.zoneID(), r)
+}
+
+func (p cloudflareProvider) Update(ctx context.Context, from, to CloudflareRecord) error {
+	return patchRecord(ctx, p.zoneID(), from, to)
+}
+
+func (p cloudflareProvider) Delete(ctx context.Context, r CloudflareRecord) error {
+	return deleteRecord(ctx, p.zoneID(), r.ID)
+}
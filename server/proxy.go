@@ -0,0 +1,246 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+// ProxyOverride replaces the configured proxied flag of a record until it expires.
+type ProxyOverride struct {
+	Proxied bool   `json:"proxied"`
+	Reason  string `json:"reason,omitempty"`
+	// the maintenance group which set the override, empty if set per record
+	Group   string     `json:"group,omitempty"`
+	Since   time.Time  `json:"since"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (v ProxyOverride) expired(now time.Time) bool {
+	return v.Expires != nil && !now.Before(*v.Expires)
+}
+
+// proxyRequest is the body of the requests which set the overrides.
+type proxyRequest struct {
+	Proxied bool   `json:"proxied"`
+	Reason  string `json:"reason"`
+	// the override expires after the duration, or at the time of expires
+	Duration zok.Duration `json:"duration"`
+	Expires  time.Time    `json:"expires"`
+}
+
+func (r proxyRequest) override(group string) (ProxyOverride, error) {
+	now := time.Now()
+	v := ProxyOverride{Proxied: r.Proxied, Reason: r.Reason, Group: group, Since: now}
+	if !r.Expires.IsZero() {
+		v.Expires = &r.Expires
+	} else if r.Duration > 0 {
+		t := now.Add(r.Duration.Value())
+		v.Expires = &t
+	}
+	if v.expired(now) {
+		return v, errors.New("proxy: already expired")
+	}
+	return v, nil
+}
+
+// proxiableRules returns the configured names of which the type is proxiable, in the group if not empty.
+func proxiableRules(group string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, v := range settings.Value().Records {
+		name := hostname(v.Name)
+		if !proxiable(v.Type) || seen[name] || (group != "" && v.Group != group) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// applyProxyOverrides replaces the proxied flag of the desired records by the overrides which are not expired.
+func (s *Server) applyProxyOverrides(desired []CloudflareRecord) []CloudflareRecord {
+	overrides := s.state.Load().Proxy
+	if len(overrides) == 0 {
+		return desired
+	}
+
+	now := time.Now()
+	records := make([]CloudflareRecord, 0, len(desired))
+	for _, r := range desired {
+		if v, exists := overrides[hostname(r.Name)]; exists && !v.expired(now) && proxiable(r.Type) {
+			r.Proxied = v.Proxied
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// restoreProxy removes the expired overrides, the configured flags are published by the next apply.
+func (s *Server) restoreProxy() {
+	now := time.Now()
+	var expired []string
+	for name, v := range s.state.Load().Proxy {
+		if v.expired(now) {
+			expired = append(expired, name)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	if err := s.state.Update(func(st *State) {
+		m := maps.Clone(st.Proxy)
+		for _, name := range expired {
+			delete(m, name)
+		}
+		st.Proxy = m
+	}); err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, name := range expired {
+		log.Infof("proxy %s: expired, restore the configured state", name)
+	}
+	audit("proxy restore", map[string]any{"names": expired})
+}
+
+// scheduleProxyRestore triggers an apply at the expiry of the override.
+func (s *Server) scheduleProxyRestore(v ProxyOverride) {
+	if v.Expires != nil {
+		time.AfterFunc(max(time.Until(*v.Expires), 0), s.trigger)
+	}
+}
+
+// setProxy replaces the overrides of the names, or removes them if the override is nil.
+func (s *Server) setProxy(names []string, v *ProxyOverride) error {
+	err := s.state.Update(func(st *State) {
+		m := maps.Clone(st.Proxy)
+		if m == nil {
+			m = map[string]ProxyOverride{}
+		}
+		for _, name := range names {
+			if v == nil {
+				delete(m, name)
+			} else {
+				m[name] = *v
+			}
+		}
+		st.Proxy = m
+	})
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		audit("proxy restore", map[string]any{"names": names})
+	} else {
+		audit("proxy", map[string]any{"names": names, "override": v})
+		s.scheduleProxyRestore(*v)
+	}
+
+	s.trigger()
+	return nil
+}
+
+func (s *Server) GetProxy(c *gin.Context) {
+	m := s.state.Load().Proxy
+	if m == nil {
+		m = map[string]ProxyOverride{}
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// SetRecordProxy overrides the proxied flag of the records of the name.
+func (s *Server) SetRecordProxy(c *gin.Context) {
+	name := hostname(c.Param("name"))
+	if !slices.Contains(proxiableRules(""), name) {
+		Abort404(c, fmt.Errorf("proxy %s: no proxiable record", name))
+		return
+	}
+
+	var body proxyRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		AbortBadRequestError(c, err)
+		return
+	}
+
+	v, err := body.override("")
+	if err != nil {
+		AbortBadRequestError(c, err)
+		return
+	}
+
+	if err := s.setProxy([]string{name}, &v); err != nil {
+		Abort500(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// DeleteRecordProxy restores the configured proxied flag of the records of the name.
+func (s *Server) DeleteRecordProxy(c *gin.Context) {
+	if err := s.setProxy([]string{hostname(c.Param("name"))}, nil); err != nil {
+		Abort500(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, struct{}{})
+}
+
+// StartMaintenance overrides the proxied flag of the records in the group.
+func (s *Server) StartMaintenance(c *gin.Context) {
+	group := c.Param("group")
+	names := proxiableRules(group)
+	if len(names) == 0 {
+		Abort404(c, fmt.Errorf("maintenance %s: no proxiable record in the group", group))
+		return
+	}
+
+	var body proxyRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		AbortBadRequestError(c, err)
+		return
+	}
+
+	v, err := body.override(group)
+	if err != nil {
+		AbortBadRequestError(c, err)
+		return
+	}
+
+	if err := s.setProxy(names, &v); err != nil {
+		Abort500(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"names": names, "override": v})
+}
+
+// StopMaintenance restores the configured proxied flag of the records overridden by the group.
+func (s *Server) StopMaintenance(c *gin.Context) {
+	group := c.Param("group")
+	var names []string
+	for name, v := range s.state.Load().Proxy {
+		if v.Group == group {
+			names = append(names, name)
+		}
+	}
+
+	if err := s.setProxy(names, nil); err != nil {
+		Abort500(c, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"names": names})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// reverseName returns the name of the PTR record of the address, in the nibble format for IPv6.
+func reverseName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	var labels []string
+	if addr.Is4() {
+		b := addr.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+
+	const hex = "0123456789abcdef"
+	b := addr.As16()
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, string(hex[b[i]&0xf]), string(hex[b[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+// reverseZone returns the reverse zone which contains the name.
+func reverseZone(name string) (settings.ReverseZone, bool) {
+	var zone settings.ReverseZone
+	for _, z := range settings.Value().ReverseZones {
+		n := hostname(z.Name)
+		if (name == n || strings.HasSuffix(name, "."+n)) && len(n) > len(zone.Name) {
+			zone = settings.ReverseZone{Zone: z.Zone, Name: n}
+		}
+	}
+	return zone, zone.Zone != ""
+}
+
+// ptrFamily returns the type of the address records of which the PTR record of the name is.
+func ptrFamily(name string) string {
+	if strings.HasSuffix(hostname(name), ".ip6.arpa") {
+		return "AAAA"
+	}
+	return "A"
+}
+
+// desiredPTRs returns the PTR records of the desired addresses grouped by the reverse zone,
+// and the names and types of which the addresses are resolved.
+func desiredPTRs(desired []CloudflareRecord) (map[string][]CloudflareRecord, map[recordKey]bool) {
+	enabled := map[recordKey]bool{}
+	for _, v := range settings.Value().Records {
+		if v.PTR && (v.Type == "A" || v.Type == "AAAA") {
+			enabled[keyOf(v.Name, v.Type)] = true
+		}
+	}
+
+	zones := map[string][]CloudflareRecord{}
+	owners := map[recordKey]bool{}
+	for _, r := range desired {
+		k := keyOf(r.Name, r.Type)
+		if !enabled[k] {
+			continue
+		}
+		owners[k] = true
+
+		addr, err := netip.ParseAddr(r.Content)
+		if err != nil {
+			continue
+		}
+		name := reverseName(addr)
+		zone, ok := reverseZone(name)
+		if !ok {
+			continue
+		}
+		zones[zone.Zone] = append(zones[zone.Zone], CloudflareRecord{
+			Name:    name,
+			Type:    "PTR",
+			Content: hostname(r.Name),
+			TTL:     r.TTL,
+		})
+	}
+	return zones, owners
+}
+
+// planReverse computes the changes of the PTR records of a reverse zone. Only the live PTR records
+// pointing to the owners of the same family are taken into account, and those not desired are deleted.
+func planReverse(records, desired []CloudflareRecord, owners map[recordKey]bool) *Plan {
+	var live []CloudflareRecord
+	for _, r := range records {
+		if r.Type == "PTR" && owners[keyOf(r.Content, ptrFamily(r.Name))] {
+			live = append(live, r)
+		}
+	}
+	return planRecords(live, desired, func(recordKey) bool { return false })
+}
+
+// syncReverse maintains the PTR records of the desired addresses in the reverse zones. The PTR records
+// pointing to a managed name with a stale address are deleted, the others are left untouched.
+// A name of which the addresses of a family are not resolved yet keeps its PTR records of the family.
+func (s *Server) syncReverse(ctx context.Context, desired []CloudflareRecord) error {
+	zones, owners := desiredPTRs(desired)
+
+	var errs []error
+	for _, z := range settings.Value().ReverseZones {
+		p := cloudflareProvider{zone: z.Zone}
+
+		records, err := p.Records(ctx, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			continue
+		}
+
+		if _, err := planReverse(records, zones[z.Zone], owners).Apply(ctx, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
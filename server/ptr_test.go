@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"::ffff:192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		if got := reverseName(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("reverseName(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestPlanReverse(t *testing.T) {
+	ptr := func(id, addr, target string) CloudflareRecord {
+		return CloudflareRecord{ID: id, Name: reverseName(netip.MustParseAddr(addr)), Type: "PTR", Content: target}
+	}
+	owners := map[recordKey]bool{keyOf("host.example.com", "AAAA"): true}
+
+	tests := []struct {
+		name    string
+		live    []CloudflareRecord
+		desired []CloudflareRecord
+		owners  map[recordKey]bool
+		want    []Action
+	}{
+		{
+			name:    "unchanged",
+			live:    []CloudflareRecord{ptr("1", "2001:db8:1::1", "host.example.com")},
+			desired: []CloudflareRecord{ptr("", "2001:db8:1::1", "host.example.com")},
+		},
+		{
+			name:    "prefix changed",
+			live:    []CloudflareRecord{ptr("1", "2001:db8:1::1", "host.example.com")},
+			desired: []CloudflareRecord{ptr("", "2001:db8:2::1", "host.example.com")},
+			want:    []Action{ActionCreate, ActionDelete},
+		},
+		{
+			name: "other owner untouched",
+			live: []CloudflareRecord{
+				ptr("1", "2001:db8:1::1", "host.example.com"),
+				ptr("2", "2001:db8:1::2", "other.example.com"),
+			},
+			desired: []CloudflareRecord{ptr("", "2001:db8:2::1", "host.example.com")},
+			want:    []Action{ActionCreate, ActionDelete},
+		},
+		{
+			name: "other family unresolved",
+			live: []CloudflareRecord{
+				ptr("1", "192.0.2.1", "host.example.com"),
+				ptr("2", "2001:db8:1::1", "host.example.com"),
+			},
+			desired: []CloudflareRecord{ptr("", "192.0.2.2", "host.example.com")},
+			owners:  map[recordKey]bool{keyOf("host.example.com", "A"): true},
+			want:    []Action{ActionCreate, ActionDelete},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.owners == nil {
+				tt.owners = owners
+			}
+			plan := planReverse(tt.live, tt.desired, tt.owners)
+			if len(plan.Changes) != len(tt.want) {
+				t.Fatalf("changes = %v, want %v", plan.Changes, tt.want)
+			}
+			for i, c := range plan.Changes {
+				if c.Action != tt.want[i] {
+					t.Errorf("change %d = %s, want %s", i, c, tt.want[i])
+				}
+				if c.Action == ActionDelete && c.From.ID != "1" {
+					t.Errorf("change %d deletes %s", i, c.From)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+type CloudflareRecordData struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+	Flags    uint8  `json:"flags"`
+	Tag      string `json:"tag"`
+	Value    string `json:"value"`
+}
+
+// hasData reports whether the record type is described by the structured "data" field instead of "content".
+func hasData(typ string) bool {
+	switch typ {
+	case "SRV", "CAA", "HTTPS", "SVCB":
+		return true
+	}
+	return false
+}
+
+func hasPriority(typ string) bool {
+	return typ == "MX"
+}
+
+func proxiable(typ string) bool {
+	switch typ {
+	case "A", "AAAA", "CNAME":
+		return true
+	}
+	return false
+}
+
+func hostname(s string) string {
+	return strings.ToLower(strings.TrimSuffix(s, "."))
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+func normalizeContent(typ, content string) string {
+	switch typ {
+	case "CNAME", "MX", "NS", "PTR":
+		return hostname(content)
+	case "TXT":
+		return unquote(content)
+	}
+	return content
+}
+
+// Value returns the presentation form of the record data, like the one shown in the Cloudflare dashboard.
+func (r CloudflareRecord) Value() string {
+	switch {
+	case r.Type == "SRV" && r.Data != nil:
+		return fmt.Sprintf("%d %d %d %s", r.Data.Priority, r.Data.Weight, r.Data.Port, r.Data.Target)
+	case r.Type == "CAA" && r.Data != nil:
+		return fmt.Sprintf("%d %s %s", r.Data.Flags, r.Data.Tag, strconv.Quote(r.Data.Value))
+	case (r.Type == "HTTPS" || r.Type == "SVCB") && r.Data != nil:
+		return fmt.Sprintf("%d %s %s", r.Data.Priority, r.Data.Target, r.Data.Value)
+	case hasPriority(r.Type) && r.Priority != nil:
+		return fmt.Sprintf("%d %s", *r.Priority, r.Content)
+	}
+	return r.Content
+}
+
+func (r CloudflareRecord) String() string {
+	return fmt.Sprintf("{%s %s: %s}", r.Type, r.Name, r.Value())
+}
+
+// sameValue reports whether two records carry the same data, ignoring proxied and ttl.
+func sameValue(a, b CloudflareRecord) bool {
+	if a.Type != b.Type {
+		return false
+	}
+
+	if hasData(a.Type) {
+		if a.Data == nil || b.Data == nil {
+			return a.Data == b.Data
+		}
+		x, y := *a.Data, *b.Data
+		x.Target, y.Target = hostname(x.Target), hostname(y.Target)
+		switch a.Type {
+		case "SRV":
+			x.Flags, x.Tag, x.Value = 0, "", ""
+			y.Flags, y.Tag, y.Value = 0, "", ""
+		case "CAA":
+			x.Priority, x.Weight, x.Port, x.Target = 0, 0, 0, ""
+			y.Priority, y.Weight, y.Port, y.Target = 0, 0, 0, ""
+		default:
+			x.Weight, x.Port, x.Flags, x.Tag = 0, 0, 0, ""
+			y.Weight, y.Port, y.Flags, y.Tag = 0, 0, 0, ""
+		}
+		return x == y
+	}
+
+	if hasPriority(a.Type) {
+		var p, q uint16
+		if a.Priority != nil {
+			p = *a.Priority
+		}
+		if b.Priority != nil {
+			q = *b.Priority
+		}
+		if p != q {
+			return false
+		}
+	}
+
+	return normalizeContent(a.Type, a.Content) == normalizeContent(b.Type, b.Content)
+}
+
+// sameRecord reports whether the live record already matches the desired one.
+func sameRecord(live, want CloudflareRecord) bool {
+	if !sameValue(live, want) {
+		return false
+	}
+	if proxiable(want.Type) && live.Proxied != want.Proxied {
+		return false
+	}
+	// proxied records always report automatic ttl
+	if !live.Proxied && want.TTL != 0 && live.TTL != want.TTL {
+		return false
+	}
+	return true
+}
+
+type recordKey struct {
+	Name string
+	Type string
+}
+
+func (k recordKey) String() string {
+	return k.Type + " " + k.Name
+}
+
+func keyOf(name, typ string) recordKey {
+	return recordKey{Name: hostname(name), Type: typ}
+}
+
+// managed reports whether the name and type is configured, or is the one of the leader lease.
+func managed(k recordKey) bool {
+	if lease, ok := leaseKey(); ok && k == lease {
+		return true
+	}
+	for _, v := range settings.Value().Records {
+		if keyOf(v.Name, v.Type) == k {
+			return true
+		}
+	}
+	return false
+}
+
+// desiredRecords resolves the configured records grouped by name and type.
+// A group is left out entirely if any of its values can not be resolved yet,
+// so that the records at Cloudflare stay untouched.
+func (s *Server) desiredRecords(rules []settings.Record, discovery *Discovery) []CloudflareRecord {
+	var keys []recordKey
+	groups := map[recordKey][]CloudflareRecord{}
+	unresolved := map[recordKey]bool{}
+
+	for _, rule := range rules {
+		k := keyOf(rule.Name, rule.Type)
+		if _, exists := groups[k]; !exists {
+			keys = append(keys, k)
+			groups[k] = nil
+		}
+
+		d, err := discovery.WAN(rule.WAN)
+		if err != nil {
+			log.Warnf("record {%s %s}: %s", rule.Type, rule.Name, err)
+			unresolved[k] = true
+			continue
+		}
+
+		up, err := s.healthy(rule.HealthCheck)
+		if err != nil {
+			log.Warnf("record {%s %s}: %s", rule.Type, rule.Name, err)
+			unresolved[k] = true
+			continue
+		}
+
+		values := rule.Contents
+		if !up {
+			if len(rule.Failover) == 0 {
+				log.Warnf("record {%s %s}: health check %s is down, but no failover", rule.Type, rule.Name, rule.HealthCheck)
+				unresolved[k] = true
+				continue
+			}
+			values = rule.Failover
+		}
+
+		explicit := len(values) > 0
+		if !explicit {
+			values = []string{""}
+		}
+
+		for _, v := range values {
+			content, target := rule.Content, rule.Target
+			if explicit {
+				if rule.Type == "SRV" {
+					target = v
+				} else {
+					content = v
+				}
+			}
+
+			r, ok := desiredRecord(rule, content, target, d)
+			if !ok {
+				unresolved[k] = true
+				continue
+			}
+
+			var dup bool
+			for _, x := range groups[k] {
+				if sameValue(x, r) {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				groups[k] = append(groups[k], r)
+			}
+		}
+	}
+
+	var records []CloudflareRecord
+	for _, k := range keys {
+		if unresolved[k] {
+			continue
+		}
+		records = append(records, groups[k]...)
+	}
+	return records
+}
+
+// desiredRecord resolves a configured record into the record expected at Cloudflare.
+// It returns false when the record can not be resolved yet, e.g. the address is not detected.
+func desiredRecord(rule settings.Record, content, target string, d *Discovery) (CloudflareRecord, bool) {
+	r := CloudflareRecord{
+		Name: rule.Name,
+		Type: rule.Type,
+		TTL:  rule.TTL,
+	}
+
+	if r.TTL == 0 {
+		r.TTL = 1
+	}
+
+	if proxiable(rule.Type) {
+		r.Proxied = rule.Proxied
+	}
+
+	if content == "" {
+		switch rule.Type {
+		case "A":
+			content = "{{.IPv4}}"
+		case "AAAA":
+			content = "{{.IPv6}}"
+		}
+	}
+
+	var err error
+	if content, err = render(content, d); err != nil {
+		if !errors.Is(err, ErrAddrNotFound) {
+			log.Warnf("record {%s %s}: %s", rule.Type, rule.Name, err)
+		}
+		return r, false
+	}
+
+	if target, err = render(target, d); err != nil {
+		if !errors.Is(err, ErrAddrNotFound) {
+			log.Warnf("record {%s %s}: %s", rule.Type, rule.Name, err)
+		}
+		return r, false
+	}
+
+	switch rule.Type {
+	case "SRV":
+		r.Data = &CloudflareRecordData{
+			Priority: rule.Priority,
+			Weight:   rule.Weight,
+			Port:     rule.Port,
+			Target:   target,
+		}
+		if r.Data.Target == "" {
+			log.Warnf("record {%s %s}: target is required", rule.Type, rule.Name)
+			return r, false
+		}
+		return r, true
+	case "CAA":
+		r.Data = &CloudflareRecordData{
+			Flags: rule.Flags,
+			Tag:   rule.Tag,
+			Value: content,
+		}
+		if r.Data.Tag == "" || r.Data.Value == "" {
+			log.Warnf("record {%s %s}: tag and content are required", rule.Type, rule.Name)
+			return r, false
+		}
+		return r, true
+	case "HTTPS", "SVCB":
+		r.Data = &CloudflareRecordData{
+			Priority: rule.Priority,
+			Target:   target,
+			Value:    content,
+		}
+		if r.Data.Target == "" {
+			r.Data.Target = "."
+		}
+		return r, true
+	case "MX":
+		p := rule.Priority
+		r.Priority = &p
+	}
+
+	r.Content = content
+
+	if r.Content == "" {
+		log.Warnf("record {%s %s}: content is required", rule.Type, rule.Name)
+		return r, false
+	}
+
+	return r, true
+}
+
+// recordBody returns the request body of a record for create and update.
+func recordBody(r CloudflareRecord) map[string]any {
+	body := map[string]any{
+		"name": r.Name,
+		"type": r.Type,
+	}
+
+	if r.TTL != 0 {
+		body["ttl"] = r.TTL
+	}
+
+	if proxiable(r.Type) {
+		body["proxied"] = r.Proxied
+	}
+
+	if r.Priority != nil {
+		body["priority"] = *r.Priority
+	}
+
+	if r.Comment != "" {
+		body["comment"] = r.Comment
+	}
+
+	if r.Data == nil {
+		body["content"] = r.Content
+		return body
+	}
+
+	switch r.Type {
+	case "SRV":
+		body["data"] = map[string]any{
+			"priority": r.Data.Priority,
+			"weight":   r.Data.Weight,
+			"port":     r.Data.Port,
+			"target":   r.Data.Target,
+		}
+	case "CAA":
+		body["data"] = map[string]any{
+			"flags": r.Data.Flags,
+			"tag":   r.Data.Tag,
+			"value": r.Data.Value,
+		}
+	default:
+		body["data"] = map[string]any{
+			"priority": r.Data.Priority,
+			"target":   r.Data.Target,
+			"value":    r.Data.Value,
+		}
+	}
+
+	return body
+}
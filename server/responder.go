@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// responder answers authoritatively for the configured records with the desired contents,
+// and with the LAN contents to a client in the LAN. A proxied record is not answered outside the LAN.
+type responder struct {
+	mu      sync.RWMutex
+	records map[recordKey][]CloudflareRecord
+	lan     map[recordKey][]CloudflareRecord
+	names   map[string]bool
+
+	ttl      uint32
+	networks []netip.Prefix
+	upstream string
+}
+
+func newResponder() (*responder, error) {
+	v := settings.Value().Responder
+	r := &responder{ttl: uint32(v.TTL), upstream: v.Upstream}
+	if r.ttl == 0 {
+		r.ttl = 60
+	}
+
+	for _, s := range v.LANNetworks {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("responder: invalid lan network: %q", s)
+		}
+		r.networks = append(r.networks, prefix.Masked())
+	}
+
+	r.set(nil, nil)
+	return r, nil
+}
+
+func groupRecords(records []CloudflareRecord) map[recordKey][]CloudflareRecord {
+	m := map[recordKey][]CloudflareRecord{}
+	for _, r := range records {
+		k := keyOf(r.Name, r.Type)
+		m[k] = append(m[k], r)
+	}
+	return m
+}
+
+// set replaces the records which are answered.
+func (r *responder) set(records, lan []CloudflareRecord) {
+	names := map[string]bool{}
+	for _, v := range settings.Value().Records {
+		names[hostname(v.Name)] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = groupRecords(records)
+	r.lan = groupRecords(lan)
+	r.names = names
+}
+
+// isLAN reports whether the client is in the LAN, default to the private, loopback, link-local and CGNAT addresses.
+func (r *responder) isLAN(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if len(r.networks) > 0 {
+		for _, p := range r.networks {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || cgnat.Contains(addr)
+}
+
+// lookup returns the records of the key answered to the client, the origin of a proxied record
+// is answered in the LAN only.
+func (r *responder) lookup(k recordKey, lan bool) []CloudflareRecord {
+	if lan {
+		if v, exists := r.lan[k]; exists {
+			return v
+		}
+		return r.records[k]
+	}
+	return slices.DeleteFunc(slices.Clone(r.records[k]), func(v CloudflareRecord) bool { return v.Proxied })
+}
+
+// answer returns the answers of the name, following a CNAME of the managed records.
+func (r *responder) answer(name dnsmessage.Name, typ dnsmessage.Type, lan bool) ([]dnsmessage.Resource, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var answers []dnsmessage.Resource
+	host := hostname(name.String())
+	if !r.names[host] {
+		return nil, false
+	}
+
+	for range 8 {
+		var found []CloudflareRecord
+		if typ == dnsmessage.TypeALL {
+			for t := range dnsTypes {
+				found = append(found, r.lookup(keyOf(host, t), lan)...)
+			}
+			found = append(found, r.lookup(keyOf(host, "SRV"), lan)...)
+		} else {
+			for t, v := range dnsTypes {
+				if v == typ {
+					found = r.lookup(keyOf(host, t), lan)
+				}
+			}
+			if typ == dnsmessage.TypeSRV {
+				found = r.lookup(keyOf(host, "SRV"), lan)
+			}
+		}
+
+		cname := r.lookup(keyOf(host, "CNAME"), lan)
+		if len(found) == 0 && len(cname) > 0 {
+			found = cname[:1]
+		}
+
+		for _, v := range found {
+			res, err := resource(v, dnsmessage.ClassINET, r.ttl)
+			if err != nil {
+				continue
+			}
+			res.Header.Name = name
+			answers = append(answers, res)
+		}
+
+		if len(found) == 0 || found[0].Type != "CNAME" || typ == dnsmessage.TypeCNAME {
+			break
+		}
+
+		host = hostname(found[0].Content)
+		if !r.names[host] {
+			break
+		}
+		next, err := dnsmessage.NewName(fqdn(host))
+		if err != nil {
+			break
+		}
+		name = next
+	}
+
+	return answers, true
+}
+
+// handle returns the packed response of the request, or nil if the request is not answerable.
+func (r *responder) handle(ctx context.Context, req []byte, client netip.Addr, stream bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || msg.Response || len(msg.Questions) != 1 {
+		return nil
+	}
+
+	q := msg.Questions[0]
+	res := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               msg.ID,
+			Response:         true,
+			OpCode:           msg.OpCode,
+			RecursionDesired: msg.RecursionDesired,
+		},
+		Questions: msg.Questions,
+	}
+
+	answers, ok := r.answer(q.Name, q.Type, r.isLAN(client))
+	switch {
+	case msg.OpCode != 0:
+		res.RCode = dnsmessage.RCodeNotImplemented
+	case q.Class != dnsmessage.ClassINET:
+		res.RCode = dnsmessage.RCodeRefused
+	case ok:
+		res.Authoritative = true
+		res.Answers = answers
+	// forwarded for the clients in the LAN only, an open forwarder is abused for amplification
+	case r.upstream != "" && (r.isLAN(client) || client.Unmap().IsLoopback()):
+		network := "udp"
+		if stream {
+			network = "tcp"
+		}
+		_, raw, err := dnsExchangeWire(ctx, defaultWAN, network, r.upstream, req)
+		if err == nil {
+			return raw
+		}
+		log.Debug("responder:", err)
+		res.RCode = dnsmessage.RCodeServerFailure
+	default:
+		res.RCode = dnsmessage.RCodeRefused
+	}
+
+	b, err := res.Pack()
+	if err != nil {
+		return nil
+	}
+
+	if !stream {
+		size := 512
+		for _, v := range msg.Additionals {
+			if v.Header.Type == dnsmessage.TypeOPT && int(v.Header.Class) > size {
+				size = int(v.Header.Class)
+			}
+		}
+		if len(b) > size {
+			res.Answers = nil
+			res.Truncated = true
+			if b, err = res.Pack(); err != nil {
+				return nil
+			}
+		}
+	}
+
+	return b
+}
+
+func (r *responder) serveUDP(ctx context.Context, conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error(fmt.Errorf("responder: %w", err))
+			}
+			return
+		}
+		req := append([]byte{}, buf[:n]...)
+		go func() {
+			client, _ := netip.ParseAddrPort(addr.String())
+			if b := r.handle(ctx, req, client.Addr(), false); b != nil {
+				conn.WriteTo(b, addr)
+			}
+		}()
+	}
+}
+
+func (r *responder) serveTCP(ctx context.Context, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error(fmt.Errorf("responder: %w", err))
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			client, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				var l [2]byte
+				if _, err := io.ReadFull(conn, l[:]); err != nil {
+					return
+				}
+				req := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				b := r.handle(ctx, req, client.Addr(), true)
+				if b == nil {
+					return
+				}
+				if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// serve listens on the address until the context is done. The bind is retried with a backoff,
+// e.g. the address is not released yet by the previous server after a reload of the config.
+func (r *responder) serve(ctx context.Context, addr string) {
+	delay := time.Second
+	for {
+		err := r.listen(ctx, addr)
+		if err == nil {
+			return
+		}
+		log.Warnf("%s, retry in %s", err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, time.Minute)
+	}
+}
+
+// listen listens on the address over udp and tcp until the context is done.
+func (r *responder) listen(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("responder: %w", err)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("responder: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		ln.Close()
+	}()
+
+	log.Info("dns responder listen:", addr)
+	go r.serveUDP(ctx, pc)
+	go r.serveTCP(ctx, ln)
+	return nil
+}
+
+// lanRecords resolves the LAN contents of the configured records.
+func (s *Server) lanRecords(d *Discovery) []CloudflareRecord {
+	var rules []settings.Record
+	for _, v := range settings.Value().Records {
+		if len(v.LAN) == 0 {
+			continue
+		}
+		v.Content, v.Contents = "", v.LAN
+		v.HealthCheck, v.Failover = "", nil
+		rules = append(rules, v)
+	}
+	return s.desiredRecords(rules, d)
+}
+
+// initResponder starts the DNS responder, which answers with the last applied records until the next run.
+func (s *Server) initResponder(ctx context.Context) error {
+	addr := settings.Value().Responder.Listen
+	if addr == "" {
+		return nil
+	}
+
+	r, err := newResponder()
+	if err != nil {
+		return err
+	}
+
+	if v := s.state.Load().Applied; v != nil {
+		r.set(v.Records, nil)
+	}
+
+	go r.serve(ctx, addr)
+	s.responder = r
+	return nil
+}
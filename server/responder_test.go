@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResponderForward(t *testing.T) {
+	r := &responder{upstream: "127.0.0.1:1", networks: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}}
+
+	q, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("example.org."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client string
+		want   dnsmessage.RCode
+	}{
+		{"203.0.113.1", dnsmessage.RCodeRefused},
+		{"10.0.0.1", dnsmessage.RCodeRefused},
+		// the upstream is not reachable
+		{"192.168.1.1", dnsmessage.RCodeServerFailure},
+		{"127.0.0.1", dnsmessage.RCodeServerFailure},
+	}
+
+	for _, tt := range tests {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(r.handle(context.Background(), q, netip.MustParseAddr(tt.client), true)); err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != tt.want {
+			t.Errorf("client %s: rcode = %s, want %s", tt.client, msg.RCode, tt.want)
+		}
+	}
+}
+
+func TestResponderServeRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		(&responder{}).serve(ctx, addr)
+		close(done)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	ln.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the address is not bound after it is released")
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestResponderProxied(t *testing.T) {
+	loadSettings(t, `{"records": [{"name": "www.example.com", "type": "A"}, {"name": "mail.example.com", "type": "A"}]}`)
+
+	r := &responder{ttl: 60, networks: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}}
+	r.set([]CloudflareRecord{
+		{Name: "www.example.com", Type: "A", Content: "198.51.100.1", Proxied: true},
+		{Name: "mail.example.com", Type: "A", Content: "198.51.100.2"},
+	}, nil)
+
+	tests := []struct {
+		client string
+		name   string
+		want   int
+	}{
+		{"192.168.1.1", "www.example.com.", 1},
+		{"203.0.113.1", "www.example.com.", 0},
+		{"203.0.113.1", "mail.example.com.", 1},
+	}
+
+	for _, tt := range tests {
+		q, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: 1},
+			Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(tt.name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+		}).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(r.handle(context.Background(), q, netip.MustParseAddr(tt.client), true)); err != nil {
+			t.Fatal(err)
+		}
+		if msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != tt.want {
+			t.Errorf("client %s, %s: rcode = %s, answers = %d, want %d", tt.client, tt.name, msg.RCode, len(msg.Answers), tt.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// https://www.rfc-editor.org/rfc/rfc2136
+
+const classNONE = 254
+
+var ErrUnsupportedType = errors.New("unsupported record type")
+
+// rfc2136Provider writes the records to a DNS server by dynamic updates.
+type rfc2136Provider struct {
+	name    string
+	server  string
+	zone    string
+	network string
+	ttl     int
+	key     *tsigKey
+}
+
+func newRFC2136Provider(v settings.RFC2136) (*rfc2136Provider, error) {
+	p := &rfc2136Provider{
+		name:    v.Name,
+		server:  v.Server,
+		zone:    hostname(v.Zone),
+		network: v.Network,
+		ttl:     v.TTL,
+	}
+	if p.name == "" {
+		p.name = p.server
+	}
+	if p.server == "" || p.zone == "" {
+		return nil, fmt.Errorf("rfc2136 %s: server and zone are required", p.name)
+	}
+	if p.network == "" {
+		p.network = "udp"
+	}
+	if p.network != "udp" && p.network != "tcp" {
+		return nil, fmt.Errorf("rfc2136 %s: unsupported network: %q", p.name, p.network)
+	}
+	if p.ttl <= 0 {
+		p.ttl = 300
+	}
+	if v.TSIGName != "" {
+		key, err := newTSIGKey(v.TSIGName, v.TSIGAlgorithm, v.TSIGSecret)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2136 %s: %w", p.name, err)
+		}
+		p.key = key
+	}
+	return p, nil
+}
+
+func (p *rfc2136Provider) String() string {
+	return "rfc2136 " + p.name
+}
+
+// inZone reports whether the name is in the zone of the server.
+func (p *rfc2136Provider) inZone(name string) bool {
+	name = hostname(name)
+	return name == p.zone || strings.HasSuffix(name, "."+p.zone)
+}
+
+// desired returns the records of the zone as published by the server,
+// of which the proxy is not applicable and the automatic ttl is the one of the server.
+func (p *rfc2136Provider) desired(records []CloudflareRecord) []CloudflareRecord {
+	var v []CloudflareRecord
+	for _, r := range records {
+		if !p.inZone(r.Name) {
+			continue
+		}
+		if _, ok := dnsTypes[r.Type]; !ok && r.Type != "SRV" {
+			continue
+		}
+		r.Proxied = false
+		if r.TTL <= 1 {
+			r.TTL = p.ttl
+		}
+		v = append(v, r)
+	}
+	return v
+}
+
+// Records queries the server for the records of the keys, a server does not list the zone without a transfer.
+func (p *rfc2136Provider) Records(ctx context.Context, keys []recordKey) ([]CloudflareRecord, error) {
+	var records []CloudflareRecord
+	for _, k := range keys {
+		t, ok := dnsTypes[k.Type]
+		if k.Type == "SRV" {
+			t, ok = dnsmessage.TypeSRV, true
+		}
+		if !ok {
+			continue
+		}
+
+		res, err := DNSQuery(ctx, defaultWAN, p.network, p.server, k.Name, t, dnsmessage.ClassINET)
+		if err != nil {
+			if res != nil && res.RCode == dnsmessage.RCodeNameError {
+				continue
+			}
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		for _, a := range res.Answers {
+			if a.Header.Type != t || hostname(a.Header.Name.String()) != k.Name {
+				continue
+			}
+			r := CloudflareRecord{Name: k.Name, Type: k.Type, TTL: int(a.Header.TTL)}
+			switch v := a.Body.(type) {
+			case *dnsmessage.AResource:
+				r.Content = netip.AddrFrom4(v.A).String()
+			case *dnsmessage.AAAAResource:
+				r.Content = netip.AddrFrom16(v.AAAA).String()
+			case *dnsmessage.CNAMEResource:
+				r.Content = hostname(v.CNAME.String())
+			case *dnsmessage.TXTResource:
+				r.Content = dnsTXT(v)
+			case *dnsmessage.MXResource:
+				r.Content = hostname(v.MX.String())
+				r.Priority = &v.Pref
+			case *dnsmessage.SRVResource:
+				r.Data = &CloudflareRecordData{Priority: v.Priority, Weight: v.Weight, Port: v.Port, Target: hostname(v.Target.String())}
+			}
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
+
+// resource returns the resource of the record, of which the class is NONE to delete it.
+func resource(r CloudflareRecord, class dnsmessage.Class, ttl uint32) (dnsmessage.Resource, error) {
+	name, err := dnsmessage.NewName(fqdn(r.Name))
+	if err != nil {
+		return dnsmessage.Resource{}, err
+	}
+
+	v := dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}}
+
+	target := func(s string) (dnsmessage.Name, error) {
+		return dnsmessage.NewName(fqdn(s))
+	}
+
+	switch r.Type {
+	case "A", "AAAA":
+		addr, err := netip.ParseAddr(r.Content)
+		if err != nil {
+			return v, err
+		}
+		if r.Type == "A" && addr.Is4() {
+			v.Body = &dnsmessage.AResource{A: addr.As4()}
+		} else if r.Type == "AAAA" && addr.Is6() {
+			v.Body = &dnsmessage.AAAAResource{AAAA: addr.As16()}
+		} else {
+			return v, fmt.Errorf("invalid address: %s", r.Content)
+		}
+	case "CNAME":
+		n, err := target(r.Content)
+		if err != nil {
+			return v, err
+		}
+		v.Body = &dnsmessage.CNAMEResource{CNAME: n}
+	case "TXT":
+		s := unquote(r.Content)
+		var txt []string
+		for len(s) > 255 {
+			txt, s = append(txt, s[:255]), s[255:]
+		}
+		v.Body = &dnsmessage.TXTResource{TXT: append(txt, s)}
+	case "MX":
+		n, err := target(r.Content)
+		if err != nil {
+			return v, err
+		}
+		var pref uint16
+		if r.Priority != nil {
+			pref = *r.Priority
+		}
+		v.Body = &dnsmessage.MXResource{Pref: pref, MX: n}
+	case "SRV":
+		if r.Data == nil {
+			return v, errors.New("no data")
+		}
+		n, err := target(r.Data.Target)
+		if err != nil {
+			return v, err
+		}
+		v.Body = &dnsmessage.SRVResource{Priority: r.Data.Priority, Weight: r.Data.Weight, Port: r.Data.Port, Target: n}
+	default:
+		return v, fmt.Errorf("%w: %s", ErrUnsupportedType, r.Type)
+	}
+
+	return v, nil
+}
+
+// update sends an UPDATE message of which the update section deletes and adds the records.
+func (p *rfc2136Provider) update(ctx context.Context, del, add []CloudflareRecord) error {
+	zone, err := dnsmessage.NewName(fqdn(p.zone))
+	if err != nil {
+		return err
+	}
+
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{OpCode: 5},
+		Questions: []dnsmessage.Question{
+			{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	for _, r := range del {
+		v, err := resource(r, classNONE, 0)
+		if err != nil {
+			return err
+		}
+		msg.Authorities = append(msg.Authorities, v)
+	}
+
+	for _, r := range add {
+		v, err := resource(r, dnsmessage.ClassINET, uint32(r.TTL))
+		if err != nil {
+			return err
+		}
+		msg.Authorities = append(msg.Authorities, v)
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	msg.ID = binary.BigEndian.Uint16(id[:])
+
+	b, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	var mac []byte
+	if p.key != nil {
+		b, mac = p.key.Sign(b)
+	}
+
+	res, raw, err := dnsExchangeWire(ctx, defaultWAN, p.network, p.server, b)
+	if err != nil {
+		return err
+	}
+
+	// the response is verified first, an error of the TSIG is reported in it with the rcode NOTAUTH
+	if p.key != nil {
+		if err := p.key.Verify(raw, mac); err != nil {
+			if res.RCode != dnsmessage.RCodeSuccess {
+				return fmt.Errorf("%s: update: %s: %w", p, res.RCode, err)
+			}
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+
+	if res.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("%s: update: %s", p, res.RCode)
+	}
+
+	return nil
+}
+
+func (p *rfc2136Provider) Create(ctx context.Context, r CloudflareRecord) error {
+	return p.update(ctx, nil, []CloudflareRecord{r})
+}
+
+func (p *rfc2136Provider) Update(ctx context.Context, from, to CloudflareRecord) error {
+	return p.update(ctx, []CloudflareRecord{from}, []CloudflareRecord{to})
+}
+
+func (p *rfc2136Provider) Delete(ctx context.Context, r CloudflareRecord) error {
+	return p.update(ctx, []CloudflareRecord{r}, nil)
+}
+
+func rfc2136Providers() ([]*rfc2136Provider, error) {
+	var providers []*rfc2136Provider
+	for _, v := range settings.Value().RFC2136 {
+		p, err := newRFC2136Provider(v)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// syncProviders converges the records of the servers updated by RFC 2136 to the desired ones.
+func (s *Server) syncProviders(ctx context.Context, desired []CloudflareRecord) {
+	for _, p := range s.providers {
+		records := p.desired(desired)
+
+		var keys []recordKey
+		for _, v := range settings.Value().Records {
+			k := keyOf(v.Name, v.Type)
+			if p.inZone(k.Name) && !slices.Contains(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+
+		live, err := p.Records(ctx, keys)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		if _, err := planRecords(live, records, managed).Apply(ctx, p); err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// updateServer is a name server of the zone which accepts the dynamic updates signed by the key.
+type updateServer struct {
+	key *tsigKey
+
+	mu      sync.Mutex
+	reply   func(req []byte, reqMAC []byte, res dnsmessage.Message) []byte // the response to an update, signed by the key if nil
+	records []CloudflareRecord
+	updates []dnsmessage.Message
+}
+
+// appendTSIG appends the TSIG record of the response to the request of the MAC, signed at the time with the error.
+func (s *updateServer) appendTSIG(msg, reqMAC []byte, signed time.Time, rcode uint16) []byte {
+	k := s.key
+	var mac []byte
+	if rcode != 16 && rcode != 17 {
+		prefix := binary.BigEndian.AppendUint16(nil, uint16(len(reqMAC)))
+		mac = k.mac(prefix, reqMAC, msg, k.variables(uint64(signed.Unix()), tsigFudge, rcode, nil))
+	}
+
+	rdata := wireName(k.algorithm)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(uint64(signed.Unix())>>32))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(signed.Unix()))
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0:2]...)
+	rdata = binary.BigEndian.AppendUint16(rdata, rcode)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	b := slices.Concat(msg, wireName(k.name))
+	b = binary.BigEndian.AppendUint16(b, typeTSIG)
+	b = binary.BigEndian.AppendUint16(b, classANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	b = append(b, rdata...)
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	return b
+}
+
+// verifyRequest returns the MAC of the signed request, or nil if the signature is bad.
+func (s *updateServer) verifyRequest(req []byte) []byte {
+	k := s.key
+	i := bytes.LastIndex(req, wireName(k.name))
+	if i < 12 || binary.BigEndian.Uint16(req[10:]) == 0 {
+		return nil
+	}
+	head := req[i+len(wireName(k.name)):]
+	if len(head) < 10 || binary.BigEndian.Uint16(head) != typeTSIG {
+		return nil
+	}
+	v, err := parseTSIG(head[10:])
+	if err != nil {
+		return nil
+	}
+	msg := slices.Clone(req[:i])
+	binary.BigEndian.PutUint16(msg, v.id)
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])-1)
+	if !hmac.Equal(k.mac(msg, k.variables(v.signed, v.fudge, v.rcode, v.other)), v.mac) {
+		return nil
+	}
+	return v.mac
+}
+
+func (s *updateServer) handle(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	res := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, OpCode: msg.OpCode, Authoritative: true},
+		Questions: msg.Questions,
+	}
+
+	if msg.OpCode == 0 {
+		q := msg.Questions[0]
+		for _, r := range s.records {
+			if fqdn(r.Name) != q.Name.String() || q.Type != dnsmessage.TypeA {
+				continue
+			}
+			a := netip.MustParseAddr(r.Content).As4()
+			res.Answers = append(res.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: uint32(r.TTL)},
+				Body:   &dnsmessage.AResource{A: a},
+			})
+		}
+		if len(res.Answers) == 0 {
+			res.RCode = dnsmessage.RCodeNameError
+		}
+		b, _ := res.Pack()
+		return b
+	}
+
+	reqMAC := s.verifyRequest(req)
+	if reqMAC == nil {
+		res.RCode = rcodeNotAuth
+		b, _ := res.Pack()
+		return s.appendTSIG(b, nil, time.Now(), 16)
+	}
+
+	if s.reply != nil {
+		return s.reply(req, reqMAC, res)
+	}
+
+	s.updates = append(s.updates, msg)
+	for _, a := range msg.Authorities {
+		v, ok := a.Body.(*dnsmessage.AResource)
+		if !ok {
+			continue
+		}
+		r := CloudflareRecord{Name: hostname(a.Header.Name.String()), Type: "A", Content: netip.AddrFrom4(v.A).String(), TTL: int(a.Header.TTL)}
+		switch a.Header.Class {
+		case classNONE:
+			s.records = slices.DeleteFunc(s.records, func(v CloudflareRecord) bool { return v.Name == r.Name && v.Content == r.Content })
+		case dnsmessage.ClassINET:
+			s.records = append(s.records, r)
+		}
+	}
+
+	b, _ := res.Pack()
+	b, _ = s.key.sign(b, reqMAC)
+	return b
+}
+
+// serve serves the zone on a local address of the network until the test ends.
+func (s *updateServer) serve(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go func() {
+			buf := make([]byte, 65535)
+			for {
+				n, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if b := s.handle(slices.Clone(buf[:n])); b != nil {
+					pc.WriteTo(b, addr)
+				}
+			}
+		}()
+		return pc.LocalAddr().String()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var l [2]byte
+					if _, err := io.ReadFull(conn, l[:]); err != nil {
+						return
+					}
+					req := make([]byte, binary.BigEndian.Uint16(l[:]))
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+					b := s.handle(req)
+					if b == nil {
+						return
+					}
+					conn.Write(slices.Concat(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+const testTSIGSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+
+// rcodeNotAuth is NOTAUTH, the rcode of the response to a request which is not signed by the key.
+const rcodeNotAuth dnsmessage.RCode = 9
+
+func newUpdateServer(t *testing.T) *updateServer {
+	t.Helper()
+	k, err := newTSIGKey("key.example.com", "hmac-sha256", testTSIGSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &updateServer{key: k}
+}
+
+func testRFC2136Provider(t *testing.T, addr, network, secret string) *rfc2136Provider {
+	t.Helper()
+	p, err := newRFC2136Provider(settings.RFC2136{
+		Server:     addr,
+		Zone:       "example.com",
+		Network:    network,
+		TSIGName:   "key.example.com",
+		TSIGSecret: secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			s := newUpdateServer(t)
+			p := testRFC2136Provider(t, s.serve(t, network), network, testTSIGSecret)
+			ctx := context.Background()
+			keys := []recordKey{keyOf("home.example.com", "A")}
+
+			records, err := p.Records(ctx, keys)
+			if err != nil || len(records) != 0 {
+				t.Fatalf("records = %v, err = %v", records, err)
+			}
+
+			a := CloudflareRecord{Name: "home.example.com", Type: "A", Content: "192.0.2.1", TTL: 300}
+			b := CloudflareRecord{Name: "home.example.com", Type: "A", Content: "192.0.2.2", TTL: 300}
+			if err := p.Create(ctx, a); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Update(ctx, a, b); err != nil {
+				t.Fatal(err)
+			}
+
+			records, err = p.Records(ctx, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []CloudflareRecord{b}; !slices.Equal(records, want) {
+				t.Fatalf("records = %v, want %v", records, want)
+			}
+
+			if err := p.Delete(ctx, b); err != nil {
+				t.Fatal(err)
+			}
+			if len(s.records) != 0 {
+				t.Errorf("records = %v", s.records)
+			}
+
+			// the sections of the updates: the zone, then the deletions of the class NONE and the additions
+			type section struct {
+				class   dnsmessage.Class
+				ttl     uint32
+				content string
+			}
+			want := [][]section{
+				{{dnsmessage.ClassINET, 300, "192.0.2.1"}},
+				{{classNONE, 0, "192.0.2.1"}, {dnsmessage.ClassINET, 300, "192.0.2.2"}},
+				{{classNONE, 0, "192.0.2.2"}},
+			}
+			if len(s.updates) != len(want) {
+				t.Fatalf("updates = %d, want %d", len(s.updates), len(want))
+			}
+			for i, msg := range s.updates {
+				if q := msg.Questions[0]; q.Name.String() != "example.com." || q.Type != dnsmessage.TypeSOA {
+					t.Errorf("update %d: zone = %v", i, q)
+				}
+				var got []section
+				for _, a := range msg.Authorities {
+					got = append(got, section{a.Header.Class, a.Header.TTL, netip.AddrFrom4(a.Body.(*dnsmessage.AResource).A).String()})
+				}
+				if !slices.Equal(got, want[i]) {
+					t.Errorf("update %d: %v, want %v", i, got, want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRFC2136ProviderErrors(t *testing.T) {
+	signed := func(rcode dnsmessage.RCode, at time.Duration, err uint16) func(*updateServer) func([]byte, []byte, dnsmessage.Message) []byte {
+		return func(s *updateServer) func([]byte, []byte, dnsmessage.Message) []byte {
+			return func(req, reqMAC []byte, res dnsmessage.Message) []byte {
+				res.RCode = rcode
+				b, _ := res.Pack()
+				return s.appendTSIG(b, reqMAC, time.Now().Add(at), err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		reply  func(*updateServer) func([]byte, []byte, dnsmessage.Message) []byte
+		want   error
+		errMsg string
+	}{
+		{name: "refused", reply: signed(dnsmessage.RCodeRefused, 0, 0), errMsg: "update: RCodeRefused"},
+		{name: "bad signature of the request", secret: "b3RoZXI=", want: ErrTSIGBadSig, errMsg: "update: 9"},
+		{name: "bad time of the request", reply: signed(rcodeNotAuth, 0, 18), want: ErrTSIGBadTime},
+		{name: "bad time of the response", reply: signed(dnsmessage.RCodeSuccess, time.Hour, 0), want: ErrTSIGBadTime},
+		{
+			name: "response of another key",
+			reply: func(s *updateServer) func([]byte, []byte, dnsmessage.Message) []byte {
+				other, _ := newTSIGKey("key.example.com", "hmac-sha256", "b3RoZXI=")
+				return func(req, reqMAC []byte, res dnsmessage.Message) []byte {
+					b, _ := res.Pack()
+					b, _ = other.sign(b, reqMAC)
+					return b
+				}
+			},
+			want: ErrTSIGBadSig,
+		},
+		{
+			name: "unsigned response",
+			reply: func(s *updateServer) func([]byte, []byte, dnsmessage.Message) []byte {
+				return func(req, reqMAC []byte, res dnsmessage.Message) []byte {
+					b, _ := res.Pack()
+					return b
+				}
+			},
+			want: ErrTSIGMissing,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newUpdateServer(t)
+			if tt.reply != nil {
+				s.reply = tt.reply(s)
+			}
+			secret := tt.secret
+			if secret == "" {
+				secret = testTSIGSecret
+			}
+			p := testRFC2136Provider(t, s.serve(t, "udp"), "udp", secret)
+
+			err := p.Create(context.Background(), CloudflareRecord{Name: "home.example.com", Type: "A", Content: "192.0.2.1", TTL: 300})
+			if err == nil {
+				t.Fatal("err = nil")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("err = %v, want %q", err, tt.errMsg)
+			}
+			if len(s.updates) != 0 {
+				t.Errorf("updates = %d", len(s.updates))
+			}
+		})
+	}
+}
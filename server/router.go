@@ -6,6 +6,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
 	"github.com/lightyen/cloudflare-ddns/zok/log"
 )
 
@@ -45,11 +46,42 @@ func (s *Server) buildRouter() http.Handler {
 			c.String(http.StatusOK, settings.Version)
 		})
 
+		api.GET("/status", s.GetStatus)
+
 		api.GET("/logs", s.GetLogs)
 		api.DELETE("/logs", s.DeleteLogs)
 
+		api.GET("/audit", s.GetAudit)
+
+		api.GET("/snapshots", s.GetSnapshots)
+		api.GET("/snapshots/:id", s.GetSnapshot)
+		api.GET("/snapshots/:id/diff", s.DiffSnapshot)
+		api.POST("/snapshots/:id/rollback", s.RollbackSnapshot)
+
+		api.GET("/zone/export", s.ExportZone)
+		api.POST("/zone/import", s.ImportZone)
+		api.GET("/zone/records", s.GetZoneRecords)
+		api.POST("/zone/records/adopt", s.AdoptRecords)
+
+		api.POST("/pause", s.Pause)
+		api.POST("/resume", s.Resume)
+
+		api.GET("/proxy", s.GetProxy)
+		api.POST("/records/:name/proxy", s.SetRecordProxy)
+		api.DELETE("/records/:name/proxy", s.DeleteRecordProxy)
+		api.POST("/maintenance/:group", s.StartMaintenance)
+		api.DELETE("/maintenance/:group", s.StopMaintenance)
+
 		api.POST("/records/apply", func(c *gin.Context) {
-			s.apply <- struct{}{}
+			// publish the pending addresses without waiting for the stability condition
+			if zok.IsTrueValue(c.Query("immediate")) {
+				s.immediate.Store(true)
+			}
+			// list the records from Cloudflare even if they are the same as the last applied ones
+			if zok.IsTrueValue(c.Query("resync")) {
+				s.resync.Store(true)
+			}
+			s.trigger()
 			c.JSON(200, struct{}{})
 		})
 	}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApplyRoute(t *testing.T) {
+	s := &Server{apply: make(chan struct{}, 1)}
+	h := s.buildRouter()
+
+	// the request does not wait for the reconciliation, which is pending already
+	for range 2 {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/vapi/records/apply?resync=1", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+
+	if len(s.apply) != 1 || !s.resync.Load() {
+		t.Errorf("pending = %d, resync = %t", len(s.apply), s.resync.Load())
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,19 +19,68 @@ import (
 )
 
 type Server struct {
-	handler http.Handler
-	apply   chan struct{}
+	handler   http.Handler
+	mu        sync.Mutex // serializes the changes of the zone records
+	apply     chan struct{}
+	immediate atomic.Bool
+	resync    atomic.Bool
+	wans      map[string]*wan
+	health    map[string]*healthCheck
+	stability *stability
+	status    *status
+	state     *store
+	providers []*rfc2136Provider
+	responder *responder
+	elector   elector
+	leader    atomic.Bool
+	notifiers map[string]notifier
+	outbox    chan struct{}
+	failure   string // the last failure of the reconciliation
 }
 
 func New() *Server {
+	st := loadStore(stateFilename())
 	return &Server{
-		apply: make(chan struct{}, 1),
+		apply:     make(chan struct{}, 1),
+		stability: newStability(st),
+		outbox:    make(chan struct{}, 1),
+		status:    &status{},
+		state:     st,
 	}
 }
 
 func (s *Server) init(ctx context.Context) (err error) {
 	s.handler = s.buildRouter()
-	// go s.ddns(ctx)
+	if s.wans, err = wans(); err != nil {
+		log.Error(err)
+	}
+	if s.providers, err = rfc2136Providers(); err != nil {
+		log.Error(err)
+	}
+	if err := s.initHealthChecks(); err != nil {
+		log.Error(err)
+	}
+	s.healthCheck(ctx)
+	if err := s.initResponder(ctx); err != nil {
+		log.Error(err)
+	}
+	if s.elector, err = newElector(instanceID()); err != nil {
+		log.Error(err)
+	} else if s.elector != nil {
+		go s.elect(ctx)
+	}
+	if s.notifiers, err = notifiers(); err != nil {
+		log.Error(err)
+	}
+	s.stability.changed = s.notifyAddress
+	go s.deliver(ctx)
+	if digestEnabled() {
+		go s.sendDigests(ctx)
+	}
+	for _, v := range s.state.Load().Proxy {
+		s.scheduleProxyRestore(v)
+	}
+	go s.ddns(ctx)
 	return nil
 }
 
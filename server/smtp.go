@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+const (
+	SMTPStartTLS = "starttls"
+	SMTPTLS      = "tls"
+	SMTPNone     = "none"
+)
+
+// address returns the address of the mailbox, e.g. "a@example.com" of "A <a@example.com>".
+func address(s string) string {
+	if v, err := mail.ParseAddress(s); err == nil {
+		return v.Address
+	}
+	return s
+}
+
+// mailer delivers the events by email.
+type mailer struct {
+	host     string
+	addr     string
+	security string
+	username string
+	password string
+	from     string
+	to       []string
+	events   []string
+	digest   bool
+	rootCAs  *x509.CertPool // the system roots if nil
+}
+
+func newMailer(v settings.SMTP) (*mailer, error) {
+	m := &mailer{
+		host:     v.Host,
+		security: v.Security,
+		username: v.Username,
+		password: v.Password,
+		from:     v.From,
+		to:       v.To,
+		events:   v.Events,
+		digest:   v.Digest != "",
+	}
+	if m.security == "" {
+		m.security = SMTPStartTLS
+	}
+	port := v.Port
+	switch m.security {
+	case SMTPStartTLS, SMTPNone:
+		if port == 0 {
+			port = 587
+		}
+	case SMTPTLS:
+		if port == 0 {
+			port = 465
+		}
+	default:
+		return nil, fmt.Errorf("smtp: unsupported security: %q", m.security)
+	}
+	m.addr = net.JoinHostPort(m.host, strconv.Itoa(port))
+
+	// the credentials are never sent in plaintext, PLAIN auth is refused by the client without TLS
+	if m.security == SMTPNone && m.username != "" {
+		return nil, errors.New("smtp: the username requires the security starttls or tls")
+	}
+
+	if m.from == "" || len(m.to) == 0 {
+		return nil, errors.New("smtp: from and to are required")
+	}
+	if len(m.events) == 0 {
+		m.events = []string{EventFailure}
+	}
+	if v.Digest != "" {
+		if _, err := time.Parse("15:04", v.Digest); err != nil {
+			return nil, fmt.Errorf("smtp: invalid digest time: %q", v.Digest)
+		}
+	}
+	return m, nil
+}
+
+func (m *mailer) String() string {
+	return "smtp " + m.host
+}
+
+func (m *mailer) accepts(typ string) bool {
+	if typ == EventDigest {
+		return m.digest
+	}
+	return acceptsEvent(m.events, typ)
+}
+
+// message returns the email of the event.
+func (m *mailer) message(e Event) []byte {
+	var id [8]byte
+	rand.Read(id[:])
+	domain := m.host
+	if _, v, ok := strings.Cut(address(m.from), "@"); ok {
+		domain = v
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", m.from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Title))
+	fmt.Fprintf(buf, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s.%s@%s>\r\n", e.ID, hex.EncodeToString(id[:]), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+
+	body := e.Message + "\n"
+	if e.Data != nil && e.Type != EventDigest {
+		if b, err := json.MarshalIndent(e.Data, "", "  "); err == nil {
+			body += "\n" + string(b) + "\n"
+		}
+	}
+	// dot-stuffing is done by the data writer
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+func (m *mailer) tlsConfig() *tls.Config {
+	return &tls.Config{ServerName: m.host, RootCAs: m.rootCAs}
+}
+
+func (m *mailer) dial(ctx context.Context) (*smtp.Client, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if m.security == SMTPTLS {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: m.tlsConfig()}).DialContext(ctx, "tcp", m.addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", m.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// send delivers the event to the recipients, with STARTTLS or implicit TLS and AUTH if configured.
+func (m *mailer) send(ctx context.Context, e Event) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	c, err := m.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	defer c.Close()
+
+	if m.security == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s: STARTTLS is not supported by the server", m)
+		}
+		if err := c.StartTLS(m.tlsConfig()); err != nil {
+			return fmt.Errorf("%s: %w", m, err)
+		}
+	}
+
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return fmt.Errorf("%s: %w", m, err)
+		}
+	}
+
+	if err := c.Mail(address(m.from)); err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	for _, to := range m.to {
+		if err := c.Rcpt(address(to)); err != nil {
+			return fmt.Errorf("%s: %w", m, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	if _, err := w.Write(m.message(e)); err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%s: %w", m, err)
+	}
+	return c.Quit()
+}
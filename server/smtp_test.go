@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// testCertificate returns a self-signed certificate of 127.0.0.1 and the pool of it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// smtpSession is what the stand-in server received.
+type smtpSession struct {
+	tls  bool
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// serveSMTP serves a session of the SMTP submission with STARTTLS and AUTH PLAIN.
+func serveSMTP(conn net.Conn, config *tls.Config, session *smtpSession) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 127.0.0.1 ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO":
+			if !session.tls {
+				tc.PrintfLine("250-127.0.0.1")
+				tc.PrintfLine("250 STARTTLS")
+			} else {
+				tc.PrintfLine("250-127.0.0.1")
+				tc.PrintfLine("250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			tc.PrintfLine("220 ready")
+			c := tls.Server(conn, config)
+			if err := c.Handshake(); err != nil {
+				return
+			}
+			session.tls = true
+			tc = textproto.NewConn(c)
+		case "AUTH":
+			mech, resp, _ := strings.Cut(arg, " ")
+			b, err := base64.StdEncoding.DecodeString(resp)
+			if !session.tls || mech != "PLAIN" || err != nil {
+				tc.PrintfLine("535 authentication failed")
+				continue
+			}
+			session.auth = string(b)
+			tc.PrintfLine("235 ok")
+		case "MAIL":
+			session.from = arg
+			tc.PrintfLine("250 ok")
+		case "RCPT":
+			session.to = append(session.to, arg)
+			tc.PrintfLine("250 ok")
+		case "DATA":
+			tc.PrintfLine("354 go ahead")
+			b, err := tc.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			session.data = string(b)
+			tc.PrintfLine("250 ok")
+		case "QUIT":
+			tc.PrintfLine("221 bye")
+			return
+		default:
+			tc.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func TestMailerSend(t *testing.T) {
+	cert, pool := testCertificate(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	session := &smtpSession{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		serveSMTP(conn, &tls.Config{Certificates: []tls.Certificate{cert}}, session)
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).AddrPort().Port()
+	m, err := newMailer(settings.SMTP{
+		Host:     "127.0.0.1",
+		Port:     int(port),
+		Username: "user",
+		Password: "pass",
+		From:     "DDNS <ddns@example.com>",
+		To:       []string{"admin@example.com", "Ops <ops@example.com>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.rootCAs = pool
+
+	e := Event{ID: "1", Type: EventFailure, Title: "Failure", Message: "line\n.dot", Time: time.Now()}
+	if err := m.send(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if !session.tls {
+		t.Error("STARTTLS is not used")
+	}
+	if want := "\x00user\x00pass"; session.auth != want {
+		t.Errorf("auth = %q, want %q", session.auth, want)
+	}
+	if want := "FROM:<ddns@example.com>"; session.from != want {
+		t.Errorf("from = %q, want %q", session.from, want)
+	}
+	if want := []string{"TO:<admin@example.com>", "TO:<ops@example.com>"}; !reflect.DeepEqual(session.to, want) {
+		t.Errorf("to = %q, want %q", session.to, want)
+	}
+	if !strings.Contains(session.data, "Subject: Failure\n") || !strings.HasSuffix(session.data, "\nline\n.dot\n") {
+		t.Errorf("data:\n%s", session.data)
+	}
+}
+
+func TestNewMailer(t *testing.T) {
+	base := settings.SMTP{Host: "smtp.example.com", From: "a@example.com", To: []string{"b@example.com"}}
+
+	tests := []struct {
+		name    string
+		modify  func(v *settings.SMTP)
+		addr    string
+		wantErr bool
+	}{
+		{name: "starttls", modify: func(v *settings.SMTP) {}, addr: "smtp.example.com:587"},
+		{name: "tls", modify: func(v *settings.SMTP) { v.Security = SMTPTLS }, addr: "smtp.example.com:465"},
+		{name: "none", modify: func(v *settings.SMTP) { v.Security = SMTPNone; v.Port = 25 }, addr: "smtp.example.com:25"},
+		{name: "none with username", modify: func(v *settings.SMTP) { v.Security = SMTPNone; v.Username = "user" }, wantErr: true},
+		{name: "unsupported security", modify: func(v *settings.SMTP) { v.Security = "ssl" }, wantErr: true},
+		{name: "no recipient", modify: func(v *settings.SMTP) { v.To = nil }, wantErr: true},
+		{name: "digest", modify: func(v *settings.SMTP) { v.Digest = "8:00am" }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := base
+			tt.modify(&v)
+			m, err := newMailer(v)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && m.addr != tt.addr {
+				t.Errorf("addr = %s, want %s", m.addr, tt.addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+// Snapshot is the records of the zone at a time.
+type Snapshot struct {
+	ID      string             `json:"id"`
+	Time    time.Time          `json:"time"`
+	Zone    string             `json:"zone"`
+	Reason  string             `json:"reason"`
+	Count   int                `json:"count"`
+	Records []CloudflareRecord `json:"records,omitempty"`
+}
+
+const snapshotIDLayout = "20060102T150405.000000Z"
+
+func snapshotDir() string {
+	return filepath.Join(settings.Value().DataDirectory, "snapshots")
+}
+
+func snapshotFilename(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("snapshot %s: invalid id", id)
+	}
+	return filepath.Join(snapshotDir(), id+".json"), nil
+}
+
+// takeSnapshot stores the records in the data directory and removes the expired snapshots.
+func takeSnapshot(records []CloudflareRecord, reason string) (*Snapshot, error) {
+	now := time.Now().UTC()
+	v := &Snapshot{
+		ID:      now.Format(snapshotIDLayout),
+		Time:    now,
+		Zone:    settings.Value().ZoneID,
+		Reason:  reason,
+		Count:   len(records),
+		Records: records,
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err := snapshotFilename(v.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := zok.WriteFile(filename, b, 0o600); err != nil {
+		return nil, err
+	}
+
+	if err := pruneSnapshots(); err != nil {
+		log.Warn("snapshot:", err)
+	}
+
+	return v, nil
+}
+
+func loadSnapshot(id string) (*Snapshot, error) {
+	filename, err := snapshotFilename(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	v := &Snapshot{}
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	return v, nil
+}
+
+// snapshotIDs returns the ids of the snapshots with the times of them, the newest first.
+// The id is the time of the snapshot, so the files are not read.
+func snapshotIDs() ([]string, map[string]time.Time, error) {
+	entries, err := os.ReadDir(snapshotDir())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var ids []string
+	times := map[string]time.Time{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() || strings.HasPrefix(id, ".") {
+			continue
+		}
+		t, err := time.Parse(snapshotIDLayout, id)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+		times[id] = t
+	}
+
+	slices.SortFunc(ids, func(a, b string) int { return times[b].Compare(times[a]) })
+	return ids, times, nil
+}
+
+// snapshotMeta is the leading fields of a snapshot file, the decoding stops before the records.
+func snapshotMeta(id string) (*Snapshot, error) {
+	filename, err := snapshotFilename(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	v := &Snapshot{}
+	dec := json.NewDecoder(f)
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", id, err)
+		}
+		var field any
+		switch t {
+		case "id":
+			field = &v.ID
+		case "time":
+			field = &v.Time
+		case "zone":
+			field = &v.Zone
+		case "reason":
+			field = &v.Reason
+		case "count":
+			field = &v.Count
+		case "records":
+			return v, nil
+		default:
+			field = &json.RawMessage{}
+		}
+		if err := dec.Decode(field); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", id, err)
+		}
+	}
+	return v, nil
+}
+
+// listSnapshots returns the snapshots without the records, the newest first.
+func listSnapshots() ([]*Snapshot, error) {
+	ids, _, err := snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*Snapshot
+	for _, id := range ids {
+		v, err := snapshotMeta(id)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+// pruneSnapshots removes the snapshots beyond the retention.
+func pruneSnapshots() error {
+	ids, times, err := snapshotIDs()
+	if err != nil {
+		return err
+	}
+
+	keep := settings.Value().Snapshots.Keep
+	if keep <= 0 {
+		keep = 50
+	}
+	maxAge := settings.Value().Snapshots.MaxAge.Value()
+
+	var errs []error
+	for i, id := range ids {
+		if i < keep && (maxAge <= 0 || time.Since(times[id]) <= maxAge) {
+			continue
+		}
+		filename, _ := snapshotFilename(id)
+		if err := os.Remove(filename); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// diffRecords returns the changes from the records to the others.
+func diffRecords(from, to []CloudflareRecord) *Plan {
+	return planRecords(from, to, func(recordKey) bool { return false })
+}
+
+// rollbackRules returns the configured records which keep the records of the snapshot, of which
+// the name and type is not configured. They are deleted by the next run otherwise.
+func rollbackRules(records []CloudflareRecord, published map[string]PendingAddr) []settings.Record {
+	records = slices.DeleteFunc(slices.Clone(withoutLease(records)), func(r CloudflareRecord) bool {
+		return managed(keyOf(r.Name, r.Type))
+	})
+	return adoptionRules(records, published)
+}
+
+// rollback restores the records of the zone to the snapshot. The records which are not managed
+// are added to the config after the changes, which is reloaded on the change. The lease of the leader
+// is left untouched. The next run lists the records again, the managed ones are converged to the
+// current addresses.
+func (s *Server) rollback(ctx context.Context, v *Snapshot) ([]Change, error) {
+	if v.Zone != settings.Value().ZoneID {
+		return nil, fmt.Errorf("snapshot %s: the zone %s is not the current one", v.ID, v.Zone)
+	}
+
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := getRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := takeSnapshot(records, "rollback to "+v.ID); err != nil {
+		return nil, err
+	}
+
+	changes, err := diffRecords(withoutLease(records), withoutLease(v.Records)).Apply(ctx, cloudflare)
+	audit("rollback", map[string]any{"snapshot": v.ID, "changes": changes})
+
+	if rules := rollbackRules(v.Records, s.state.Load().Addresses); len(rules) > 0 {
+		if e := settings.AddRecords(rules...); e != nil {
+			err = errors.Join(err, fmt.Errorf("config: %w", e))
+		}
+		audit("adopt", rules)
+	}
+
+	if len(changes) > 0 {
+		s.resync.Store(true)
+		s.trigger()
+	}
+	return changes, err
+}
+
+func (s *Server) GetSnapshots(c *gin.Context) {
+	items, err := listSnapshots()
+	if err != nil {
+		Abort500(c, err)
+		return
+	}
+	if items == nil {
+		items = []*Snapshot{}
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+func (s *Server) GetSnapshot(c *gin.Context) {
+	v, err := loadSnapshot(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			Abort404(c, err)
+			return
+		}
+		AbortBadRequestError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
+// DiffSnapshot returns the changes from the snapshot to the one of the query "to",
+// or to the live records if it is empty.
+func (s *Server) DiffSnapshot(c *gin.Context) {
+	from, err := loadSnapshot(c.Param("id"))
+	if err != nil {
+		Abort404(c, err)
+		return
+	}
+
+	var to []CloudflareRecord
+	if id := c.Query("to"); id != "" {
+		v, err := loadSnapshot(id)
+		if err != nil {
+			Abort404(c, err)
+			return
+		}
+		to = v.Records
+	} else {
+		to, err = getRecords(c.Request.Context())
+		if err != nil {
+			Abort500(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, diffRecords(from.Records, to))
+}
+
+func (s *Server) RollbackSnapshot(c *gin.Context) {
+	v, err := loadSnapshot(c.Param("id"))
+	if err != nil {
+		Abort404(c, err)
+		return
+	}
+
+	changes, err := s.rollback(c.Request.Context(), v)
+	if err != nil {
+		Abort500(c, err)
+		return
+	}
+
+	if changes == nil {
+		changes = []Change{}
+	}
+	c.JSON(http.StatusOK, changes)
+}
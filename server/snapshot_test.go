@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+func TestRollbackRules(t *testing.T) {
+	loadSettings(t, `{"records": [{"name": "home.example.com", "type": "A"}]}`)
+
+	snapshot := []CloudflareRecord{
+		{ID: "1", Name: "home.example.com", Type: "A", Content: "1.2.3.4", TTL: 1},
+		{ID: "2", Name: "mail.example.com", Type: "A", Content: "5.6.7.8", TTL: 1},
+		{ID: "3", Name: "mail.example.com", Type: "A", Content: "5.6.7.9", TTL: 1},
+		{ID: "4", Name: "example.com", Type: "TXT", Content: "v=spf1 -all", TTL: 3600},
+	}
+	published := map[string]PendingAddr{"default/ip4": {WAN: "default", Family: "ip4", Published: "1.2.3.4"}}
+
+	rules := rollbackRules(snapshot, published)
+	if len(rules) != 2 {
+		t.Fatalf("rules = %+v", rules)
+	}
+	if err := settings.AddRecords(rules...); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the run after the rollback
+	desired := (&Server{}).desiredRecords(settings.Value().Records, NewDiscovery("1.2.3.4", ""))
+	if plan := planRecords(snapshot, desired, managed); !plan.Empty() {
+		t.Errorf("changes = %v", plan.Changes)
+	}
+}
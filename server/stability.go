@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+type PendingAddr struct {
+	WAN       string    `json:"wan"`
+	Family    string    `json:"family"`
+	Published string    `json:"published"`
+	Candidate string    `json:"candidate"`
+	Checks    int       `json:"checks"`
+	Since     time.Time `json:"since"`
+}
+
+// stability holds back a changed address until it is detected for the configured number of consecutive
+// checks or the minimum duration, so that a flapping address is not published. The addresses are kept
+// in the state, a restart does not publish a pending address.
+type stability struct {
+	mu    sync.Mutex
+	state *store
+	addrs map[string]*PendingAddr
+	// called when a changed address is published
+	changed func(p PendingAddr, from string)
+}
+
+func newStability(st *store) *stability {
+	s := &stability{state: st, addrs: map[string]*PendingAddr{}}
+	for k, v := range st.Load().Addresses {
+		s.addrs[k] = &v
+	}
+	return s
+}
+
+// save writes the addresses to the state.
+func (s *stability) save() {
+	addrs := make(map[string]PendingAddr, len(s.addrs))
+	for k, v := range s.addrs {
+		addrs[k] = *v
+	}
+	if err := s.state.Update(func(v *State) { v.Addresses = addrs }); err != nil {
+		log.Error(fmt.Errorf("state: %w", err))
+	}
+}
+
+// stable reports whether the pending address satisfies the condition, either of the checks or the duration.
+func stable(p *PendingAddr, now time.Time) bool {
+	conf := settings.Value().Stability
+	checks, duration := conf.Checks, conf.Duration.Value()
+	if checks <= 0 && duration <= 0 {
+		return true
+	}
+	return (checks > 0 && p.Checks >= checks) || (duration > 0 && now.Sub(p.Since) >= duration)
+}
+
+// update takes the detected address and returns the one to publish.
+func (s *stability) update(w *wan, family string, addr string, immediate bool) string {
+	if addr == "" {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := w.String() + "/" + family
+	p, exists := s.addrs[key]
+	if !exists {
+		// nothing is published yet
+		s.addrs[key] = &PendingAddr{WAN: w.String(), Family: family, Published: addr}
+		s.save()
+		return addr
+	}
+
+	if addr == p.Published {
+		if p.Candidate != "" {
+			p.Candidate, p.Checks, p.Since = "", 0, time.Time{}
+			s.save()
+		}
+		return addr
+	}
+
+	now := time.Now()
+	if addr != p.Candidate {
+		p.Candidate, p.Checks, p.Since = addr, 0, now
+	}
+	p.Checks++
+
+	if immediate || stable(p, now) {
+		from := p.Published
+		p.Published, p.Candidate, p.Checks, p.Since = addr, "", 0, time.Time{}
+		s.save()
+		if s.changed != nil {
+			s.changed(*p, from)
+		}
+		return addr
+	}
+
+	s.save()
+	log.Infof("address %s (wan: %s, %s) is pending, checks: %d, since: %s", addr, w, family, p.Checks, p.Since.Format(time.RFC3339))
+	return p.Published
+}
+
+func (s *stability) pending() []PendingAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := []PendingAddr{}
+	for _, p := range s.addrs {
+		if p.Candidate != "" {
+			items = append(items, *p)
+		}
+	}
+	return items
+}
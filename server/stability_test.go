@@ -0,0 +1,62 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// loadSettings loads the config of the test, and restores the default settings after the test.
+func loadSettings(t *testing.T, config string) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(filename, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	prev := os.Getenv("CONFIG")
+	os.Setenv("CONFIG", filename)
+	if err := settings.Load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Setenv("CONFIG", prev)
+		settings.Load()
+	})
+}
+
+func TestStability(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// the published address after each check of the new address
+		want []string
+	}{
+		{"immediate", `{}`, []string{"b"}},
+		{"checks", `{"stability": {"checks": 3}}`, []string{"a", "a", "b"}},
+		{"duration", `{"stability": {"duration": "1h"}}`, []string{"a", "a", "a"}},
+		{"checks or duration", `{"stability": {"checks": 2, "duration": "1h"}}`, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadSettings(t, tt.config)
+			filename := filepath.Join(t.TempDir(), "state.json")
+			w := &wan{}
+
+			s := newStability(loadStore(filename))
+			if got := s.update(w, "ip4", "a", false); got != "a" {
+				t.Fatalf("first address = %s, want a", got)
+			}
+
+			for i, want := range tt.want {
+				// a restart keeps the pending address
+				s = newStability(loadStore(filename))
+				if got := s.update(w, "ip4", "b", false); got != want {
+					t.Errorf("check %d = %s, want %s", i+1, got, want)
+				}
+			}
+		})
+	}
+}
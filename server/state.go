@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+// State is persisted in the data directory across restarts.
+type State struct {
+	Zone    *Zone    `json:"zone,omitempty"`
+	Applied *Applied `json:"applied,omitempty"`
+	// the adopted records and the reported drifts by name and type
+	Adopted map[string]Adoption `json:"adopted,omitempty"`
+	Drift   map[string]string   `json:"drift,omitempty"`
+	// the overrides of the proxied flag by name
+	Proxy map[string]ProxyOverride `json:"proxy,omitempty"`
+	// the reconciliation is paused if not nil
+	Paused *Pause `json:"paused,omitempty"`
+	// the published and the pending addresses by WAN and family
+	Addresses map[string]PendingAddr `json:"addresses,omitempty"`
+	// the addresses published in the sets of the WAF custom rules by the name of the target
+	CustomRules map[string][]string `json:"custom_rules,omitempty"`
+}
+
+type Zone struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	NameServers []string `json:"name_servers"`
+}
+
+// Applied is the desired records last converged at Cloudflare.
+type Applied struct {
+	Zone     string             `json:"zone"`
+	Digest   string             `json:"digest"`
+	Records  []CloudflareRecord `json:"records"`
+	SyncedAt time.Time          `json:"synced_at"`
+	// the last listing of the records to detect a drift
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+type store struct {
+	mu       sync.Mutex
+	filename string
+	state    State
+}
+
+func stateFilename() string {
+	return filepath.Join(settings.Value().DataDirectory, "state.json")
+}
+
+func loadStore(filename string) *store {
+	st := &store{filename: filename}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("state:", err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(b, &st.state); err != nil {
+		log.Warn("state:", err)
+	}
+	return st
+}
+
+// Load returns a copy of the state, the fields are replaced rather than modified by Update.
+func (st *store) Load() State {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.state
+}
+
+// Update modifies the state and writes it to the file.
+func (st *store) Update(fn func(v *State)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fn(&st.state)
+	b, err := json.MarshalIndent(st.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return zok.WriteFile(st.filename, b, 0o600)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+type Status struct {
+	DetectedAt   time.Time      `json:"detected_at"`
+	Detect       []DetectResult `json:"detect"`
+	Pending      []PendingAddr  `json:"pending"`
+	HealthChecks []HealthStatus `json:"health_checks"`
+	Propagation  []Propagation  `json:"propagation"`
+	Paused       *Pause         `json:"paused"`
+	ObserveOnly  bool           `json:"observe_only"`
+	Role         string         `json:"role"`
+}
+
+// status is the runtime state reported by the status API.
+type status struct {
+	mu         sync.RWMutex
+	detectedAt time.Time
+	detect     []DetectResult
+
+	propagation []*Propagation
+}
+
+func (s *status) setDetected(results []DetectResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detectedAt = time.Now()
+	s.detect = results
+}
+
+func (s *Server) GetStatus(c *gin.Context) {
+	s.status.mu.RLock()
+	defer s.status.mu.RUnlock()
+
+	v := Status{
+		DetectedAt:   s.status.detectedAt,
+		Detect:       s.status.detect,
+		Pending:      s.stability.pending(),
+		HealthChecks: s.HealthStatus(),
+		Propagation:  []Propagation{},
+		Paused:       s.state.Load().Paused,
+		ObserveOnly:  settings.Value().ObserveOnly,
+		Role:         s.role(),
+	}
+	if v.Detect == nil {
+		v.Detect = []DetectResult{}
+	}
+	for _, p := range s.status.propagation {
+		v.Propagation = append(v.Propagation, *p)
+	}
+
+	c.JSON(http.StatusOK, v)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// STUN binding request, RFC 5389/8489
+
+const (
+	stunMagicCookie     = 0x2112A442
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunBindingError    = 0x0111
+	stunHeaderSize      = 20
+
+	stunAttrMappedAddress       = 0x0001
+	stunAttrXorMappedAddress    = 0x0020
+	stunAttrXorMappedAddressOld = 0x8020
+)
+
+var (
+	ErrSTUNMalformed = errors.New("stun: malformed message")
+
+	DefaultSTUNServers = []string{
+		"stun.cloudflare.com:3478",
+		"stun.l.google.com:19302",
+	}
+)
+
+type stunDetector struct {
+	servers []string
+}
+
+func (d *stunDetector) Detect(ctx context.Context, w *wan, family string) (string, error) {
+	var errs []error
+	for _, server := range d.servers {
+		addr, err := STUNBinding(ctx, w, "udp"+family[2:], server)
+		if err == nil {
+			return addr.String(), nil
+		}
+		errs = append(errs, fmt.Errorf("stun %s: %w", server, err))
+	}
+	if len(errs) == 0 {
+		return "", errors.New("stun: no server")
+	}
+	return "", errors.Join(errs...)
+}
+
+// STUNBinding sends binding requests to the server and returns the reflexive transport address.
+// The request is retransmitted with a doubled timeout each time, starting from 500ms.
+func STUNBinding(ctx context.Context, w *wan, network, server string) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	conn, err := w.DialContext(ctx, network, server)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+
+	var txid [12]byte
+	if _, err := rand.Read(txid[:]); err != nil {
+		return netip.Addr{}, err
+	}
+
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint16(req[2:], 0)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	copy(req[8:], txid[:])
+
+	deadline, _ := ctx.Deadline()
+	buf := make([]byte, 1500)
+	rto := 500 * time.Millisecond
+
+	for {
+		if _, err := conn.Write(req); err != nil {
+			return netip.Addr{}, err
+		}
+
+		timeout := time.Now().Add(rto)
+		if timeout.After(deadline) {
+			timeout = deadline
+		}
+		conn.SetReadDeadline(timeout)
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var e net.Error
+				if errors.As(err, &e) && e.Timeout() && time.Now().Before(deadline) {
+					break
+				}
+				return netip.Addr{}, err
+			}
+
+			addr, err := parseSTUNResponse(buf[:n], txid)
+			if errors.Is(err, errSTUNMismatch) {
+				continue
+			}
+			return addr, err
+		}
+
+		rto *= 2
+	}
+}
+
+var errSTUNMismatch = errors.New("stun: transaction mismatch")
+
+func parseSTUNResponse(b []byte, txid [12]byte) (netip.Addr, error) {
+	if len(b) < stunHeaderSize {
+		return netip.Addr{}, ErrSTUNMalformed
+	}
+
+	typ := binary.BigEndian.Uint16(b[0:])
+	length := int(binary.BigEndian.Uint16(b[2:]))
+
+	if binary.BigEndian.Uint32(b[4:]) != stunMagicCookie || !bytes.Equal(b[8:20], txid[:]) {
+		return netip.Addr{}, errSTUNMismatch
+	}
+
+	if stunHeaderSize+length > len(b) {
+		return netip.Addr{}, ErrSTUNMalformed
+	}
+
+	switch typ {
+	case stunBindingResponse:
+	case stunBindingError:
+		return netip.Addr{}, errors.New("stun: binding error response")
+	default:
+		return netip.Addr{}, errSTUNMismatch
+	}
+
+	var mapped netip.Addr
+	attrs := b[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		t := binary.BigEndian.Uint16(attrs[0:])
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			return netip.Addr{}, ErrSTUNMalformed
+		}
+		v := attrs[4 : 4+l]
+
+		switch t {
+		case stunAttrXorMappedAddress, stunAttrXorMappedAddressOld:
+			return parseSTUNAddress(v, true, txid)
+		case stunAttrMappedAddress:
+			mapped, _ = parseSTUNAddress(v, false, txid)
+		}
+
+		// attributes are padded to a multiple of 4 bytes
+		l = (l + 3) &^ 3
+		if 4+l > len(attrs) {
+			break
+		}
+		attrs = attrs[4+l:]
+	}
+
+	if mapped.IsValid() {
+		return mapped, nil
+	}
+
+	return netip.Addr{}, errors.New("stun: mapped address not found")
+}
+
+func parseSTUNAddress(v []byte, xor bool, txid [12]byte) (netip.Addr, error) {
+	if len(v) < 4 {
+		return netip.Addr{}, ErrSTUNMalformed
+	}
+
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:], stunMagicCookie)
+	copy(key[4:], txid[:])
+
+	switch v[1] {
+	case 0x01:
+		if len(v) < 8 {
+			return netip.Addr{}, ErrSTUNMalformed
+		}
+		var a [4]byte
+		copy(a[:], v[4:8])
+		if xor {
+			for i := range a {
+				a[i] ^= key[i]
+			}
+		}
+		return netip.AddrFrom4(a), nil
+	case 0x02:
+		if len(v) < 20 {
+			return netip.Addr{}, ErrSTUNMalformed
+		}
+		var a [16]byte
+		copy(a[:], v[4:20])
+		if xor {
+			for i := range a {
+				a[i] ^= key[i]
+			}
+		}
+		return netip.AddrFrom16(a), nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("stun: unknown address family: %d", v[1])
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// stunAttr returns the attribute of the address, which is xored by the magic cookie and the transaction id.
+func stunAttr(typ uint16, addr netip.Addr, port uint16, txid [12]byte) []byte {
+	ip := addr.AsSlice()
+	family := byte(0x01)
+	if addr.Is6() {
+		family = 0x02
+	}
+
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:], stunMagicCookie)
+	copy(key[4:], txid[:])
+	if typ != stunAttrMappedAddress {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+
+	v := append([]byte{0, family}, binary.BigEndian.AppendUint16(nil, port)...)
+	v = append(v, ip...)
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func stunMessage(typ uint16, txid [12]byte, attrs ...[]byte) []byte {
+	var body []byte
+	for _, a := range attrs {
+		body = append(body, a...)
+	}
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	b = binary.BigEndian.AppendUint32(b, stunMagicCookie)
+	b = append(b, txid[:]...)
+	return append(b, body...)
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	txid := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	other := [12]byte{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+	v4 := netip.MustParseAddr("203.0.113.7")
+	v6 := netip.MustParseAddr("2001:db8::1234:5678")
+	software := []byte{0x80, 0x22, 0x00, 0x03, 'a', 'b', 'c', 0x00}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want netip.Addr
+		err  error
+	}{
+		{"xor ipv4", stunMessage(stunBindingResponse, txid, stunAttr(stunAttrXorMappedAddress, v4, 50000, txid)), v4, nil},
+		{"xor ipv6", stunMessage(stunBindingResponse, txid, stunAttr(stunAttrXorMappedAddress, v6, 50000, txid)), v6, nil},
+		{"old xor", stunMessage(stunBindingResponse, txid, stunAttr(stunAttrXorMappedAddressOld, v4, 1, txid)), v4, nil},
+		{"mapped", stunMessage(stunBindingResponse, txid, stunAttr(stunAttrMappedAddress, v4, 1, txid)), v4, nil},
+		{"padded attribute first", stunMessage(stunBindingResponse, txid, software, stunAttr(stunAttrXorMappedAddress, v6, 1, txid)), v6, nil},
+		{"xor preferred", stunMessage(stunBindingResponse, txid,
+			stunAttr(stunAttrMappedAddress, netip.MustParseAddr("192.168.1.1"), 1, txid),
+			stunAttr(stunAttrXorMappedAddress, v4, 1, txid)), v4, nil},
+		{"other transaction", stunMessage(stunBindingResponse, other, stunAttr(stunAttrXorMappedAddress, v4, 1, other)), netip.Addr{}, errSTUNMismatch},
+		{"short", []byte{0x01, 0x01, 0x00}, netip.Addr{}, ErrSTUNMalformed},
+		{"truncated", stunMessage(stunBindingResponse, txid, stunAttr(stunAttrXorMappedAddress, v4, 1, txid))[:26], netip.Addr{}, ErrSTUNMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSTUNResponse(tt.msg, txid)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseSTUNResponse(stunMessage(stunBindingError, txid), txid); err == nil {
+		t.Error("an error response is accepted")
+	}
+}
+
+// TestSTUNBinding requests a local STUN responder which answers with the source address.
+func TestSTUNBinding(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < stunHeaderSize || binary.BigEndian.Uint16(buf) != stunBindingRequest {
+				continue
+			}
+			var txid [12]byte
+			copy(txid[:], buf[8:20])
+			src := addr.(*net.UDPAddr).AddrPort()
+			pc.WriteTo(stunMessage(stunBindingResponse, txid, stunAttr(stunAttrXorMappedAddress, src.Addr(), src.Port(), txid)), addr)
+		}
+	}()
+
+	got, err := STUNBinding(context.Background(), &wan{}, "udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("127.0.0.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"text/template"
+)
+
+var ErrAddrNotFound = errors.New("address not found")
+
+// Discovery is the result of the address detection, it is also the data of record templates.
+type Discovery struct {
+	ipv4     string
+	ipv6     string
+	hostname string
+	wans     map[string]*Discovery
+}
+
+func NewDiscovery(ipv4, ipv6 string) *Discovery {
+	d := &Discovery{ipv4: ipv4, ipv6: ipv6, wans: map[string]*Discovery{}}
+	d.hostname, _ = os.Hostname()
+	return d
+}
+
+// WAN returns the discovery result of the named WAN, the default route if the name is empty.
+//
+//	{{(.WAN "lte").IPv4}}
+func (d *Discovery) WAN(name string) (*Discovery, error) {
+	if name == "" {
+		return d, nil
+	}
+	v, exists := d.wans[name]
+	if !exists {
+		return nil, fmt.Errorf("wan %s: not found", name)
+	}
+	return v, nil
+}
+
+func (d *Discovery) IPv4() (string, error) {
+	if d.ipv4 == "" {
+		return "", fmt.Errorf("IPv4 %w", ErrAddrNotFound)
+	}
+	return d.ipv4, nil
+}
+
+func (d *Discovery) IPv6() (string, error) {
+	if d.ipv6 == "" {
+		return "", fmt.Errorf("IPv6 %w", ErrAddrNotFound)
+	}
+	return d.ipv6, nil
+}
+
+// Prefix returns the /64 network of the IPv6 address, e.g. "2001:db8:1:2::/64".
+func (d *Discovery) Prefix() (string, error) {
+	p, err := d.prefix()
+	if err != nil {
+		return "", err
+	}
+	return p.String(), nil
+}
+
+func (d *Discovery) prefix() (netip.Prefix, error) {
+	s, err := d.IPv6()
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return addr.Prefix(64)
+}
+
+func (d *Discovery) Hostname() string {
+	return d.hostname
+}
+
+// Host returns the address of the host with the interface identifier in the detected /64 network.
+//
+//	{{.Host "::1234"}}
+func (d *Discovery) Host(iid string) (string, error) {
+	p, err := d.prefix()
+	if err != nil {
+		return "", err
+	}
+	id, err := netip.ParseAddr(iid)
+	if err != nil || !id.Is6() {
+		return "", fmt.Errorf("invalid interface identifier: %q", iid)
+	}
+	a, b := p.Addr().As16(), id.As16()
+	for i := 8; i < 16; i++ {
+		a[i] = b[i]
+	}
+	return netip.AddrFrom16(a).String(), nil
+}
+
+var templateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    strings.ReplaceAll,
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       func(sep string, s []string) string { return strings.Join(s, sep) },
+	"default": func(def string, s string) string {
+		if s == "" {
+			return def
+		}
+		return s
+	},
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// render evaluates the text as a template against the discovery result.
+func render(text string, d *Discovery) (string, error) {
+	if !isTemplate(text) {
+		return text, nil
+	}
+	t, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	s := &strings.Builder{}
+	if err := t.Execute(s, d); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(s.String()), nil
+}
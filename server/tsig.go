@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// https://www.rfc-editor.org/rfc/rfc8945
+
+const (
+	typeTSIG  = 250
+	classANY  = 255
+	tsigFudge = 300
+)
+
+var tsigAlgorithms = map[string]struct {
+	name string
+	hash func() hash.Hash
+}{
+	"hmac-md5":    {"hmac-md5.sig-alg.reg.int.", md5.New},
+	"hmac-sha1":   {"hmac-sha1.", sha1.New},
+	"hmac-sha256": {"hmac-sha256.", sha256.New},
+	"hmac-sha512": {"hmac-sha512.", sha512.New},
+}
+
+var (
+	ErrTSIGMissing = errors.New("tsig: the response is not signed")
+	ErrTSIGBadSig  = errors.New("tsig: bad signature")
+	ErrTSIGBadKey  = errors.New("tsig: bad key")
+	ErrTSIGBadTime = errors.New("tsig: bad time")
+)
+
+// the errors of the TSIG record in the response, e.g. the server can not verify the request
+var tsigErrors = map[uint16]error{
+	16: ErrTSIGBadSig,
+	17: ErrTSIGBadKey,
+	18: ErrTSIGBadTime,
+}
+
+// tsigKey signs the messages by TSIG.
+type tsigKey struct {
+	name      string
+	algorithm string
+	hash      func() hash.Hash
+	secret    []byte
+}
+
+func newTSIGKey(name, algorithm, secret string) (*tsigKey, error) {
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	alg, exists := tsigAlgorithms[strings.ToLower(algorithm)]
+	if !exists {
+		return nil, fmt.Errorf("tsig: unsupported algorithm: %s", algorithm)
+	}
+	b, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("tsig: invalid secret: %w", err)
+	}
+	return &tsigKey{name: fqdn(strings.ToLower(name)), algorithm: alg.name, hash: alg.hash, secret: b}, nil
+}
+
+// wireName returns the uncompressed name in the canonical wire format.
+func wireName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// variables returns the TSIG variables of the digest.
+func (k *tsigKey) variables(signed uint64, fudge, rcode uint16, other []byte) []byte {
+	b := wireName(k.name)
+	b = binary.BigEndian.AppendUint16(b, classANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = append(b, wireName(k.algorithm)...)
+	b = binary.BigEndian.AppendUint16(b, uint16(signed>>32))
+	b = binary.BigEndian.AppendUint32(b, uint32(signed))
+	b = binary.BigEndian.AppendUint16(b, fudge)
+	b = binary.BigEndian.AppendUint16(b, rcode)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(other)))
+	return append(b, other...)
+}
+
+func (k *tsigKey) mac(data ...[]byte) []byte {
+	h := hmac.New(k.hash, k.secret)
+	for _, b := range data {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// Sign appends the TSIG record to the packed message, and returns the signed message and the MAC.
+func (k *tsigKey) Sign(msg []byte) ([]byte, []byte) {
+	return k.sign(msg, nil)
+}
+
+// sign signs the message, which is a response to the request of the MAC if any.
+func (k *tsigKey) sign(msg []byte, reqMAC []byte) ([]byte, []byte) {
+	var prefix []byte
+	if reqMAC != nil {
+		prefix = binary.BigEndian.AppendUint16(nil, uint16(len(reqMAC)))
+	}
+	signed := uint64(time.Now().Unix())
+	mac := k.mac(prefix, reqMAC, msg, k.variables(signed, tsigFudge, 0, nil))
+
+	rdata := wireName(k.algorithm)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(signed>>32))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(signed))
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0:2]...) // original id
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	b := append([]byte{}, msg...)
+	b = append(b, wireName(k.name)...)
+	b = binary.BigEndian.AppendUint16(b, typeTSIG)
+	b = binary.BigEndian.AppendUint16(b, classANY)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	b = append(b, rdata...)
+
+	// arcount
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])+1)
+	return b, mac
+}
+
+type tsigRecord struct {
+	algorithm string
+	signed    uint64
+	fudge     uint16
+	mac       []byte
+	id        uint16
+	rcode     uint16
+	other     []byte
+}
+
+// Verify checks the TSIG record at the end of the packed response to the request of the MAC.
+func (k *tsigKey) Verify(res []byte, reqMAC []byte) error {
+	if len(res) < 12 || binary.BigEndian.Uint16(res[10:]) == 0 {
+		return ErrTSIGMissing
+	}
+
+	// the owner of the record is either uncompressed or a pointer
+	owner := wireName(k.name)
+	var msg, rdata []byte
+	for _, n := range []int{len(owner), 2} {
+		for i := 12; i+n+10 <= len(res); i++ {
+			head := res[i+n:]
+			if binary.BigEndian.Uint16(head) != typeTSIG || binary.BigEndian.Uint16(head[2:]) != classANY {
+				continue
+			}
+			l := int(binary.BigEndian.Uint16(head[8:]))
+			if i+n+10+l != len(res) {
+				continue
+			}
+			if n == len(owner) && !bytes.EqualFold(res[i:i+n], owner) {
+				continue
+			}
+			if n == 2 && (res[i]&0xC0 != 0xC0 || !bytes.EqualFold(nameAt(res, i), owner)) {
+				continue
+			}
+			msg, rdata = res[:i], head[10:]
+			break
+		}
+		if msg != nil {
+			break
+		}
+	}
+	if msg == nil {
+		return ErrTSIGMissing
+	}
+
+	v, err := parseTSIG(rdata)
+	if err != nil {
+		return err
+	}
+
+	if v.rcode != 0 {
+		if err, exists := tsigErrors[v.rcode]; exists {
+			return fmt.Errorf("%w (reported by the server)", err)
+		}
+		return fmt.Errorf("tsig: error %d", v.rcode)
+	}
+
+	if !strings.EqualFold(v.algorithm, k.algorithm) {
+		return fmt.Errorf("tsig: unexpected algorithm: %s", v.algorithm)
+	}
+
+	b := append([]byte{}, msg...)
+	binary.BigEndian.PutUint16(b, v.id)
+	binary.BigEndian.PutUint16(b[10:], binary.BigEndian.Uint16(b[10:])-1)
+
+	prefix := binary.BigEndian.AppendUint16(nil, uint16(len(reqMAC)))
+	mac := k.mac(prefix, reqMAC, b, k.variables(v.signed, v.fudge, v.rcode, v.other))
+	if !hmac.Equal(mac, v.mac) {
+		return ErrTSIGBadSig
+	}
+
+	now := uint64(time.Now().Unix())
+	if now+uint64(v.fudge) < v.signed || v.signed+uint64(v.fudge) < now {
+		return ErrTSIGBadTime
+	}
+
+	return nil
+}
+
+// nameAt returns the uncompressed name at the offset of the message, following the compression pointers,
+// which only point backwards. It returns nil if the name is malformed.
+func nameAt(msg []byte, offset int) []byte {
+	var b []byte
+	for i, end := offset, offset; i < len(msg); {
+		l := int(msg[i])
+		switch {
+		case l == 0:
+			return append(b, 0)
+		case l&0xC0 == 0xC0:
+			if i+1 >= len(msg) {
+				return nil
+			}
+			p := int(binary.BigEndian.Uint16(msg[i:]) & 0x3FFF)
+			if p >= end {
+				return nil
+			}
+			i, end = p, p
+		case l > 63 || i+1+l > len(msg):
+			return nil
+		default:
+			b = append(b, msg[i:i+1+l]...)
+			i += 1 + l
+		}
+	}
+	return nil
+}
+
+func parseTSIG(b []byte) (*tsigRecord, error) {
+	errMalformed := errors.New("tsig: malformed record")
+
+	var labels []string
+	i := 0
+	for {
+		if i >= len(b) {
+			return nil, errMalformed
+		}
+		l := int(b[i])
+		i++
+		if l == 0 {
+			break
+		}
+		if l > 63 || i+l > len(b) {
+			return nil, errMalformed
+		}
+		labels = append(labels, string(b[i:i+l]))
+		i += l
+	}
+
+	v := &tsigRecord{algorithm: strings.Join(labels, ".") + "."}
+	if i+10 > len(b) {
+		return nil, errMalformed
+	}
+	v.signed = uint64(binary.BigEndian.Uint16(b[i:]))<<32 | uint64(binary.BigEndian.Uint32(b[i+2:]))
+	v.fudge = binary.BigEndian.Uint16(b[i+6:])
+	n := int(binary.BigEndian.Uint16(b[i+8:]))
+	i += 10
+	if i+n+6 > len(b) {
+		return nil, errMalformed
+	}
+	v.mac = b[i : i+n]
+	i += n
+	v.id = binary.BigEndian.Uint16(b[i:])
+	v.rcode = binary.BigEndian.Uint16(b[i+2:])
+	n = int(binary.BigEndian.Uint16(b[i+4:]))
+	i += 6
+	if i+n > len(b) {
+		return nil, errMalformed
+	}
+	v.other = b[i : i+n]
+	return v, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func packQuestion(t *testing.T, name string, response bool) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, Response: response},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// compressOwner replaces the owner of the TSIG record at the offset with a pointer.
+func compressOwner(k *tsigKey, b []byte, offset int, pointer []byte) []byte {
+	return slices.Concat(b[:offset], pointer, b[offset+len(wireName(k.name)):])
+}
+
+func TestTSIG(t *testing.T) {
+	secret := "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	k, err := newTSIGKey("key.example.com", "hmac-sha256", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newTSIGKey("key.example.com", "hmac-sha256", "b3RoZXI=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, reqMAC := k.Sign(packQuestion(t, "example.com.", false))
+
+	// the question name is the key name at offset 12, which is pointed by the owner
+	unsigned := packQuestion(t, "key.example.com.", true)
+	res, _ := k.sign(unsigned, reqMAC)
+	unrelated := packQuestion(t, "example.com.", true)
+	res2, _ := k.sign(unrelated, reqMAC)
+	bad, _ := other.sign(unsigned, reqMAC)
+	tampered := slices.Clone(res)
+	tampered[0] ^= 0xff
+	question := slices.Clone(res)
+	question[13] ^= 0x01
+
+	tests := []struct {
+		name   string
+		res    []byte
+		reqMAC []byte
+		want   error
+	}{
+		{name: "uncompressed", res: res, reqMAC: reqMAC},
+		{name: "pointer", res: compressOwner(k, res, len(unsigned), []byte{0xC0, 12}), reqMAC: reqMAC},
+		{name: "not a pointer", res: compressOwner(k, res, len(unsigned), []byte{0x00, 12}), reqMAC: reqMAC, want: ErrTSIGMissing},
+		{name: "pointer to another name", res: compressOwner(k, res2, len(unrelated), []byte{0xC0, 12}), reqMAC: reqMAC, want: ErrTSIGMissing},
+		{name: "unsigned", res: unsigned, reqMAC: reqMAC, want: ErrTSIGMissing},
+		{name: "other key", res: bad, reqMAC: reqMAC, want: ErrTSIGBadSig},
+		{name: "other request", res: res, reqMAC: []byte("other"), want: ErrTSIGBadSig},
+		{name: "original id", res: tampered, reqMAC: reqMAC},
+		{name: "tampered", res: question, reqMAC: reqMAC, want: ErrTSIGBadSig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := k.Verify(tt.res, tt.reqMAC); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// wan dials the outbound connections of the address detection through an uplink.
+// The zero value dials with the default route.
+type wan struct {
+	name       string
+	iface      string
+	addr4      netip.Addr
+	addr6      netip.Addr
+	gateway    netip.Addr
+	staticIPv6 string
+
+	client4 *http.Client
+	client6 *http.Client
+}
+
+func newWAN(v settings.WAN) (*wan, error) {
+	w := &wan{
+		name:       v.Name,
+		iface:      v.Interface,
+		staticIPv6: v.StaticIPv6,
+	}
+
+	if v.Address != "" {
+		addr, err := netip.ParseAddr(v.Address)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("wan %s: invalid address: %q", v.Name, v.Address)
+		}
+		w.addr4 = addr
+	}
+
+	if v.Address6 != "" {
+		addr, err := netip.ParseAddr(v.Address6)
+		if err != nil || !addr.Is6() {
+			return nil, fmt.Errorf("wan %s: invalid address6: %q", v.Name, v.Address6)
+		}
+		w.addr6 = addr
+	}
+
+	if v.Gateway != "" {
+		addr, err := netip.ParseAddr(v.Gateway)
+		if err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("wan %s: invalid gateway: %q", v.Name, v.Gateway)
+		}
+		w.gateway = addr
+	}
+
+	w.client4 = w.httpClient("tcp4")
+	w.client6 = w.httpClient("tcp6")
+	return w, nil
+}
+
+var defaultWAN, _ = newWAN(settings.WAN{})
+
+func (w *wan) String() string {
+	if w.name == "" {
+		return "default"
+	}
+	return w.name
+}
+
+func (w *wan) httpClient(network string) *http.Client {
+	t := &http.Transport{}
+	t.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return w.DialContext(ctx, network, addr)
+	}
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &http.Client{Transport: t, Timeout: 30 * time.Second}
+}
+
+func (w *wan) control(network, address string, c syscall.RawConn) error {
+	if w.iface == "" {
+		return nil
+	}
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, w.iface)
+	}); e != nil {
+		return e
+	}
+	if err != nil {
+		return fmt.Errorf("wan %s: bind to device %s: %w", w, w.iface, err)
+	}
+	return nil
+}
+
+// DialContext connects to the address on the named network, like net.Dialer,
+// bound to the interface and the source address of the WAN.
+func (w *wan) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Control: w.control}
+
+	src := w.addr4
+	if strings.HasSuffix(network, "6") {
+		src = w.addr6
+	}
+
+	if src.IsValid() {
+		switch {
+		case strings.HasPrefix(network, "tcp"):
+			d.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, 0))
+		case strings.HasPrefix(network, "udp"):
+			d.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, 0))
+		}
+	}
+
+	return d.DialContext(ctx, network, addr)
+}
+
+// wans returns the configured WANs by name.
+func wans() (map[string]*wan, error) {
+	m := map[string]*wan{}
+	for _, v := range settings.Value().WANs {
+		if v.Name == "" {
+			return nil, fmt.Errorf("wan: name is required")
+		}
+		if _, exists := m[v.Name]; exists {
+			return nil, fmt.Errorf("wan %s: duplicated", v.Name)
+		}
+		w, err := newWAN(v)
+		if err != nil {
+			return nil, err
+		}
+		m[v.Name] = w
+	}
+	return m, nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// webhookPreset is the payload shape of a notification service.
+type webhookPreset struct {
+	contentType string
+	headers     map[string]string
+	body        string
+}
+
+var webhookPresets = map[string]webhookPreset{
+	// https://docs.ntfy.sh/publish/
+	"ntfy": {
+		contentType: "text/plain; charset=utf-8",
+		headers:     map[string]string{"Title": "{{.Title}}", "Tags": "{{.Type}}"},
+		body:        "{{.Message}}",
+	},
+	// https://gotify.net/docs/pushmsg
+	"gotify": {
+		contentType: "application/json",
+		body:        `{"title":{{json .Title}},"message":{{json .Message}},"priority":5}`,
+	},
+	// https://api.slack.com/messaging/webhooks
+	"slack": {
+		contentType: "application/json",
+		body:        `{"text":{{json (printf "*%s*\n%s" .Title .Message)}}}`,
+	},
+	"": {
+		contentType: "application/json",
+		body:        "{{json .}}",
+	},
+}
+
+// webhook delivers the events by HTTP requests.
+type webhook struct {
+	name        string
+	url         string
+	method      string
+	contentType string
+	headers     map[string]*template.Template
+	body        *template.Template
+	secret      []byte
+	events      []string
+}
+
+func newWebhook(v settings.Webhook) (*webhook, error) {
+	w := &webhook{name: v.Name, url: v.URL, method: v.Method, secret: []byte(v.Secret), events: v.Events}
+	if w.name == "" {
+		w.name = v.URL
+	}
+	if w.url == "" {
+		return nil, fmt.Errorf("webhook %s: url is required", w.name)
+	}
+	if w.method == "" {
+		w.method = http.MethodPost
+	}
+
+	preset, exists := webhookPresets[v.Preset]
+	if !exists {
+		return nil, fmt.Errorf("webhook %s: unknown preset: %q", w.name, v.Preset)
+	}
+	w.contentType = preset.contentType
+
+	body := preset.body
+	if v.Body != "" {
+		body = v.Body
+	}
+
+	var err error
+	if w.body, err = template.New("body").Funcs(templateFuncs).Parse(body); err != nil {
+		return nil, fmt.Errorf("webhook %s: %w", w.name, err)
+	}
+
+	w.headers = map[string]*template.Template{}
+	headers := map[string]string{}
+	for k, v := range preset.headers {
+		headers[k] = v
+	}
+	for k, v := range v.Headers {
+		headers[k] = v
+	}
+	for k, v := range headers {
+		if w.headers[k], err = template.New(k).Funcs(templateFuncs).Parse(v); err != nil {
+			return nil, fmt.Errorf("webhook %s: header %s: %w", w.name, k, err)
+		}
+	}
+
+	return w, nil
+}
+
+func (w *webhook) String() string {
+	return "webhook " + w.name
+}
+
+func (w *webhook) accepts(typ string) bool {
+	return acceptsEvent(w.events, typ)
+}
+
+func execute(t *template.Template, e Event) (string, error) {
+	buf := &strings.Builder{}
+	if err := t.Execute(buf, e); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// send requests the webhook with the rendered body, which is signed by HMAC-SHA256
+// in the header X-Signature-256 if the secret is set.
+func (w *webhook) send(ctx context.Context, e Event) error {
+	body, err := execute(w.body, e)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, w.method, w.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", w.contentType)
+	req.Header.Set("X-Event-ID", e.ID)
+	req.Header.Set("X-Event-Type", e.Type)
+	for k, t := range w.headers {
+		v, err := execute(t, e)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(k, v)
+	}
+
+	if len(w.secret) > 0 {
+		h := hmac.New(sha256.New, w.secret)
+		h.Write([]byte(body))
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(h.Sum(nil)))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			return fmt.Errorf("%s: %s: %s", w, res.Status, b)
+		}
+		return fmt.Errorf("%s: %s", w, res.Status)
+	}
+	return nil
+}
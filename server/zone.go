@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lightyen/cloudflare-ddns/settings"
+	"github.com/lightyen/cloudflare-ddns/zok"
+	"github.com/lightyen/cloudflare-ddns/zok/log"
+)
+
+// ExportZone writes the records of the zone as a zone file.
+func ExportZone(ctx context.Context, w io.Writer) error {
+	zone, err := getZone(ctx)
+	if err != nil {
+		return err
+	}
+
+	records, err := getRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	return WriteZone(w, zone.Name, records)
+}
+
+// ImportZone parses the zone file into the configured records, and the plan which converges
+// the records of the zone to it. The NS records of the apex are skipped, which are the nameservers
+// of the previous DNS host, and so are the names and types already configured, which are left to the config.
+// Only the records of the names in the file are deleted, unless prune deletes all the records which
+// are not in the file or in the config.
+func ImportZone(ctx context.Context, data []byte, prune bool) ([]settings.Record, *Plan, error) {
+	zone, err := getZone(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, err := ParseZone(bytes.NewReader(data), zone.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	records = slices.DeleteFunc(records, func(r CloudflareRecord) bool {
+		return r.Type == "NS" && r.Name == hostname(zone.Name) || managed(keyOf(r.Name, r.Type))
+	})
+
+	live, err := getRecords(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rules := make([]settings.Record, 0, len(records))
+	names := map[string]bool{}
+	for _, r := range records {
+		rules = append(rules, recordRule(r))
+		names[r.Name] = true
+	}
+
+	kept := func(k recordKey) bool { return managed(k) || !prune && !names[k.Name] }
+	return rules, planRecords(withoutLease(live), withoutLease(records), kept), nil
+}
+
+func (s *Server) ExportZone(c *gin.Context) {
+	buf := &bytes.Buffer{}
+	if err := ExportZone(c.Request.Context(), buf); err != nil {
+		Abort500(c, err)
+		return
+	}
+	c.Data(http.StatusOK, "text/dns; charset=utf-8", buf.Bytes())
+}
+
+// ImportZone returns the configured records and the plan of the zone file in the request body.
+// The plan is applied and the records are appended to the config if the query "apply" is true,
+// the records not in the file are deleted if the query "prune" is true.
+func (s *Server) ImportZone(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		AbortBadRequestError(c, err)
+		return
+	}
+
+	rules, plan, err := ImportZone(c.Request.Context(), data, zok.IsTrueValue(c.Query("prune")))
+	if err != nil {
+		var e *SyntaxError
+		if errors.As(err, &e) {
+			AbortBadRequestError(c, err)
+			return
+		}
+		Abort500(c, err)
+		return
+	}
+
+	var applied []Change
+	if zok.IsTrueValue(c.Query("apply")) {
+		if applied, err = s.applyImport(c.Request.Context(), rules, plan); err != nil {
+			Abort500(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"records": rules, "plan": plan, "applied": applied})
+}
+
+// applyImport applies the plan of the import and appends the records to the config, which is reloaded
+// on the change. The reconciliation is held off until then, otherwise the records which are not
+// configured yet are deleted.
+func (s *Server) applyImport(ctx context.Context, rules []settings.Record, plan *Plan) ([]Change, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return importRecords(ctx, rules, plan)
+}
+
+// ApplyImport applies the plan of the import outside of the running instance, which is refused unless
+// this process wins the election of the leader. The records are appended to the config.
+func ApplyImport(ctx context.Context, rules []settings.Record, plan *Plan) ([]Change, error) {
+	if plan.Empty() && len(rules) == 0 {
+		return nil, nil
+	}
+
+	if err := writable(loadStore(stateFilename()).Load()); err != nil {
+		return nil, err
+	}
+
+	// the identity differs from the one of the running instance, even if it is configured
+	e, err := newElector(instanceID() + "-cli")
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		leader, err := e.acquire(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("leader: %w", err)
+		}
+		if !leader {
+			return nil, ErrFollower
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := e.release(ctx); err != nil {
+				log.Warn("leader:", err)
+			}
+		}()
+	}
+
+	return importRecords(ctx, rules, plan)
+}
+
+// importRecords applies the plan and then appends the records to the config, also after a failure
+// of some of the changes, which are converged by the reconciliation then.
+// The config is written after the changes, a reload of it starts a reconciliation which would
+// create the same records otherwise.
+func importRecords(ctx context.Context, rules []settings.Record, plan *Plan) ([]Change, error) {
+	changes, err := applyPlan(ctx, plan, "import")
+	if err != nil && len(changes) == 0 {
+		return nil, err
+	}
+	if len(rules) > 0 {
+		if e := settings.AddRecords(rules...); e != nil {
+			err = errors.Join(err, fmt.Errorf("config: %w", e))
+		}
+	}
+	return changes, err
+}
+
+// applyPlan applies the plan outside of the reconciliation, after a snapshot of the zone is taken.
+func applyPlan(ctx context.Context, plan *Plan, reason string) ([]Change, error) {
+	if plan.Empty() {
+		return nil, nil
+	}
+
+	records, err := getRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := takeSnapshot(records, reason); err != nil {
+		return nil, err
+	}
+
+	changes, err := plan.Apply(ctx, cloudflare)
+	audit(reason, changes)
+	return changes, err
+}
+
+// ownerComment marks the comment of a record adopted into the config.
+const ownerComment = "managed by cloudflare-ddns"
+
+type ZoneRecord struct {
+	CloudflareRecord
+	Managed bool `json:"managed"`
+}
+
+func (s *Server) GetZoneRecords(c *gin.Context) {
+	records, err := getRecords(c.Request.Context())
+	if err != nil {
+		Abort500(c, err)
+		return
+	}
+
+	items := make([]ZoneRecord, 0, len(records))
+	for _, r := range records {
+		items = append(items, ZoneRecord{CloudflareRecord: r, Managed: managed(keyOf(r.Name, r.Type))})
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+// adoptRecords appends the records of the ids to the config, and marks them as owned at Cloudflare.
+// A name and type is adopted with all of its records, one which is already configured is skipped.
+// A failure of the marking is only logged, the config is already written.
+func adoptRecords(ctx context.Context, ids []string) (adopted, skipped []CloudflareRecord, err error) {
+	records, err := getRecords(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the other records of the name and type are adopted as well, they are deleted once it is configured
+	keys := map[recordKey]bool{}
+	for _, id := range ids {
+		i := slices.IndexFunc(records, func(r CloudflareRecord) bool { return r.ID == id })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("record %s: not found", id)
+		}
+		keys[keyOf(records[i].Name, records[i].Type)] = true
+	}
+	for _, r := range records {
+		if k := keyOf(r.Name, r.Type); !keys[k] {
+			continue
+		} else if managed(k) {
+			skipped = append(skipped, r)
+			continue
+		}
+		adopted = append(adopted, r)
+	}
+
+	rules := adoptionRules(adopted, loadStore(stateFilename()).Load().Addresses)
+	if len(rules) == 0 {
+		return adopted, skipped, nil
+	}
+
+	if err := settings.AddRecords(rules...); err != nil {
+		return nil, nil, err
+	}
+
+	audit("adopt", adopted)
+
+	if err := writable(loadStore(stateFilename()).Load()); err != nil {
+		log.Warn("adopt: the records are not marked:", err)
+		return adopted, skipped, nil
+	}
+
+	for _, r := range adopted {
+		if strings.Contains(r.Comment, ownerComment) {
+			continue
+		}
+		comment := ownerComment
+		if r.Comment != "" {
+			comment = r.Comment + "; " + ownerComment
+		}
+		b, _ := json.Marshal(map[string]any{"comment": comment})
+		if err := RequestCloudflare(ctx, "PATCH", "/dns_records/"+r.ID, bytes.NewReader(b), nil); err != nil {
+			log.Warn("adopt:", err)
+		}
+	}
+
+	return adopted, skipped, nil
+}
+
+// adoptionRules returns the configured records which publish the adopted records as they are.
+//
+// The address records of a name and type are configured once, with the live contents as the set of values.
+// A content which is the published address of a WAN follows the detected address, a static one is kept.
+func adoptionRules(records []CloudflareRecord, published map[string]PendingAddr) []settings.Record {
+	type addrKey struct {
+		recordKey
+		wan string
+	}
+
+	var rules []settings.Record
+	addrs := map[addrKey]int{}
+	for _, r := range records {
+		if r.Type != "A" && r.Type != "AAAA" {
+			rules = append(rules, recordRule(r))
+			continue
+		}
+
+		family, value := "ip4", "{{.IPv4}}"
+		if r.Type == "AAAA" {
+			family, value = "ip6", "{{.IPv6}}"
+		}
+		content, wan := r.Content, ""
+		for _, p := range published {
+			if p.Family == family && p.Published != "" && p.Published == content {
+				content = value
+				if p.WAN != "default" {
+					wan = p.WAN
+				}
+				break
+			}
+		}
+
+		k := addrKey{keyOf(r.Name, r.Type), wan}
+		if i, exists := addrs[k]; exists {
+			if !slices.Contains(rules[i].Contents, content) {
+				rules[i].Contents = append(rules[i].Contents, content)
+			}
+			continue
+		}
+
+		rule := recordRule(r)
+		rule.Content, rule.Contents, rule.WAN = "", []string{content}, wan
+		addrs[k] = len(rules)
+		rules = append(rules, rule)
+	}
+
+	// a single value is the content, the detected address by default
+	for _, i := range addrs {
+		if v := rules[i].Contents; len(v) == 1 {
+			rules[i].Contents = nil
+			if v[0] != "{{.IPv4}}" && v[0] != "{{.IPv6}}" {
+				rules[i].Content = v[0]
+			}
+		}
+	}
+	return rules
+}
+
+// AdoptRecords appends the records of the ids in the request body to the config file,
+// which is reloaded on the change.
+func (s *Server) AdoptRecords(c *gin.Context) {
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		AbortBadRequestError(c, err)
+		return
+	}
+
+	adopted, skipped, err := adoptRecords(c.Request.Context(), body.IDs)
+	if err != nil {
+		Abort500(c, err)
+		return
+	}
+
+	if adopted == nil {
+		adopted = []CloudflareRecord{}
+	}
+	if skipped == nil {
+		skipped = []CloudflareRecord{}
+	}
+	c.JSON(http.StatusOK, gin.H{"adopted": adopted, "skipped": skipped})
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+func TestAdoptionRules(t *testing.T) {
+	a := func(id, name, content string) CloudflareRecord {
+		return CloudflareRecord{ID: id, Name: name, Type: "A", Content: content, TTL: 1}
+	}
+	published := map[string]PendingAddr{
+		"default/ip4": {WAN: "default", Family: "ip4", Published: "1.2.3.4"},
+		"lte/ip4":     {WAN: "lte", Family: "ip4", Published: "9.9.9.9"},
+	}
+
+	tests := []struct {
+		name string
+		live []CloudflareRecord
+		want []settings.Record
+	}{
+		{
+			name: "static",
+			live: []CloudflareRecord{a("1", "mail.example.com", "5.6.7.8"), a("2", "mail.example.com", "5.6.7.9")},
+			want: []settings.Record{{Name: "mail.example.com", Type: "A", Contents: []string{"5.6.7.8", "5.6.7.9"}}},
+		},
+		{
+			name: "single static",
+			live: []CloudflareRecord{a("1", "mail.example.com", "5.6.7.8")},
+			want: []settings.Record{{Name: "mail.example.com", Type: "A", Content: "5.6.7.8"}},
+		},
+		{
+			name: "published",
+			live: []CloudflareRecord{a("1", "home.example.com", "1.2.3.4")},
+			want: []settings.Record{{Name: "home.example.com", Type: "A"}},
+		},
+		{
+			name: "published and static",
+			live: []CloudflareRecord{a("1", "home.example.com", "1.2.3.4"), a("2", "home.example.com", "5.6.7.8")},
+			want: []settings.Record{{Name: "home.example.com", Type: "A", Contents: []string{"{{.IPv4}}", "5.6.7.8"}}},
+		},
+		{
+			name: "published by a wan",
+			live: []CloudflareRecord{a("1", "home.example.com", "9.9.9.9")},
+			want: []settings.Record{{Name: "home.example.com", Type: "A", WAN: "lte"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := adoptionRules(tt.live, published)
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Fatalf("rules = %+v, want %+v", rules, tt.want)
+			}
+
+			d := NewDiscovery("1.2.3.4", "")
+			d.wans["lte"] = NewDiscovery("9.9.9.9", "")
+			desired := (&Server{}).desiredRecords(rules, d)
+			if plan := planRecords(tt.live, desired, func(recordKey) bool { return false }); !plan.Empty() {
+				t.Errorf("changes = %v", plan.Changes)
+			}
+		})
+	}
+}
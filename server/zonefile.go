@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lightyen/cloudflare-ddns/settings"
+)
+
+// SyntaxError is an error of the zone file at the line.
+type SyntaxError struct {
+	Line int
+	Err  error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("zone: line %d: %s", e.Line, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+func syntaxError(line int, format string, a ...any) error {
+	return &SyntaxError{Line: line, Err: fmt.Errorf(format, a...)}
+}
+
+// cfProxied is the comment of a proxied record in the zone file exported by Cloudflare.
+const cfProxied = "cf_tags=cf-proxied:true"
+
+// quoteTXT returns the character-strings of the TXT data, each of which is at most 255 bytes.
+func quoteTXT(s string) string {
+	var parts []string
+	for {
+		n := min(len(s), 255)
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s[:n])
+		parts = append(parts, `"`+v+`"`)
+		s = s[n:]
+		if s == "" {
+			return strings.Join(parts, " ")
+		}
+	}
+}
+
+// txtStrings returns the character-strings of the TXT content, which is either a string
+// or the quoted strings separated by spaces, e.g. "v=DKIM1; k=rsa; " "p=MIIB...".
+func txtStrings(s string) []string {
+	if !strings.HasPrefix(s, `"`) || !strings.HasSuffix(s, `"`) {
+		return []string{s}
+	}
+
+	var parts []string
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case ' ', '\t':
+			i++
+		case '"':
+			var b strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return []string{unquote(s)}
+			}
+			i++
+			parts = append(parts, b.String())
+		default:
+			return []string{unquote(s)}
+		}
+	}
+	return parts
+}
+
+// rdata returns the record data in the presentation form of RFC 1035.
+func rdata(r CloudflareRecord) string {
+	switch {
+	case r.Type == "CNAME", r.Type == "NS", r.Type == "PTR":
+		return fqdn(r.Content)
+	case r.Type == "MX" && r.Priority != nil:
+		return fmt.Sprintf("%d %s", *r.Priority, fqdn(r.Content))
+	case r.Type == "TXT":
+		var parts []string
+		for _, v := range txtStrings(r.Content) {
+			parts = append(parts, quoteTXT(v))
+		}
+		return strings.Join(parts, " ")
+	case r.Type == "SRV" && r.Data != nil:
+		return fmt.Sprintf("%d %d %d %s", r.Data.Priority, r.Data.Weight, r.Data.Port, fqdn(r.Data.Target))
+	case (r.Type == "HTTPS" || r.Type == "SVCB") && r.Data != nil:
+		return strings.TrimSpace(fmt.Sprintf("%d %s %s", r.Data.Priority, fqdn(r.Data.Target), r.Data.Value))
+	}
+	return r.Value()
+}
+
+// WriteZone writes the records as a zone file of RFC 1035, in the form exported by Cloudflare.
+func WriteZone(w io.Writer, origin string, records []CloudflareRecord) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, ";; Domain: %s\n", origin)
+	fmt.Fprintf(b, ";; Exported: %s\n\n", time.Now().UTC().Format(time.DateTime))
+	fmt.Fprintf(b, "$ORIGIN %s\n\n", fqdn(origin))
+
+	for _, r := range records {
+		fmt.Fprintf(b, "%s\t%d\tIN\t%s\t%s", fqdn(r.Name), r.TTL, r.Type, rdata(r))
+		if r.Proxied {
+			fmt.Fprintf(b, " ; %s", cfProxied)
+		}
+		fmt.Fprintln(b)
+	}
+
+	return b.Flush()
+}
+
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneEntry is a logical line of the zone file, of which the parentheses are joined.
+type zoneEntry struct {
+	line    int
+	blank   bool // the owner is omitted
+	tokens  []zoneToken
+	comment string
+}
+
+func scanZone(r io.Reader) ([]zoneEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []zoneEntry
+	var e zoneEntry
+	var depth int
+	line := 1
+	start := true
+
+	flush := func() {
+		if len(e.tokens) > 0 {
+			entries = append(entries, e)
+		}
+		e = zoneEntry{line: line}
+		start = true
+	}
+	e.line = line
+
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+			if depth == 0 {
+				flush()
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+			if start && len(e.tokens) == 0 && depth == 0 {
+				e.blank = true
+			}
+			i++
+		case c == ';':
+			j := i
+			for j < len(data) && data[j] != '\n' {
+				j++
+			}
+			e.comment = strings.TrimSpace(string(data[i+1 : j]))
+			i = j
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			if depth == 0 {
+				return nil, syntaxError(line, "unbalanced parentheses")
+			}
+			depth--
+			i++
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				if data[i] == '\n' {
+					line++
+				}
+				b.WriteByte(data[i])
+			}
+			if i >= len(data) {
+				return nil, syntaxError(line, "unterminated string")
+			}
+			i++
+			e.tokens = append(e.tokens, zoneToken{text: b.String(), quoted: true})
+		default:
+			// a quoted part inside the token is kept verbatim, e.g. alpn="h2,h3"
+			j := i
+			for j < len(data) && !strings.ContainsRune(" \t\r\n;()", rune(data[j])) {
+				if data[j] == '"' {
+					if k := bytes.IndexByte(data[j+1:], '"'); k >= 0 {
+						j += k + 1
+					}
+				}
+				j++
+			}
+			e.tokens = append(e.tokens, zoneToken{text: string(data[i:j])})
+			i = j
+		}
+		if len(e.tokens) > 0 {
+			start = false
+		}
+	}
+
+	if depth != 0 {
+		return nil, syntaxError(line, "unbalanced parentheses")
+	}
+	flush()
+	return entries, nil
+}
+
+func absName(name, origin string) string {
+	if name == "@" {
+		return hostname(origin)
+	}
+	if strings.HasSuffix(name, ".") {
+		return hostname(name)
+	}
+	if origin == "" {
+		return hostname(name)
+	}
+	return hostname(name + "." + origin)
+}
+
+func isClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
+
+// ParseZone parses a zone file of RFC 1035 into records, the origin is used until $ORIGIN.
+// The SOA record is skipped, which is managed by Cloudflare.
+func ParseZone(r io.Reader, origin string) ([]CloudflareRecord, error) {
+	entries, err := scanZone(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []CloudflareRecord
+	var owner string
+	ttl := 1
+
+	for _, e := range entries {
+		tokens := e.tokens
+
+		switch strings.ToUpper(tokens[0].text) {
+		case "$ORIGIN":
+			if len(tokens) < 2 {
+				return nil, syntaxError(e.line, "$ORIGIN without a name")
+			}
+			origin = absName(tokens[1].text, origin)
+			continue
+		case "$TTL":
+			if len(tokens) < 2 {
+				return nil, syntaxError(e.line, "$TTL without a value")
+			}
+			n, err := strconv.Atoi(tokens[1].text)
+			if err != nil {
+				return nil, syntaxError(e.line, "invalid $TTL: %s", tokens[1].text)
+			}
+			ttl = n
+			continue
+		case "$INCLUDE", "$GENERATE":
+			return nil, syntaxError(e.line, "%s is not supported", tokens[0].text)
+		}
+
+		if !e.blank {
+			owner = absName(tokens[0].text, origin)
+			tokens = tokens[1:]
+		}
+		if owner == "" {
+			return nil, syntaxError(e.line, "no owner name")
+		}
+
+		rec := CloudflareRecord{Name: owner, TTL: ttl}
+
+		// [ttl] [class] type, or [class] [ttl] type
+		for len(tokens) > 0 {
+			if n, err := strconv.Atoi(tokens[0].text); err == nil {
+				rec.TTL = n
+			} else if !isClass(tokens[0].text) {
+				break
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return nil, syntaxError(e.line, "no record type")
+		}
+
+		rec.Type = strings.ToUpper(tokens[0].text)
+		rec.Proxied = strings.Contains(e.comment, cfProxied)
+		args := tokens[1:]
+
+		if err := parseRdata(&rec, args, origin); err != nil {
+			return nil, syntaxError(e.line, "%s: %w", rec.Type, err)
+		}
+
+		if rec.Type != "SOA" {
+			records = append(records, rec)
+		}
+	}
+
+	return records, nil
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	return uint16(n), err
+}
+
+func parseRdata(rec *CloudflareRecord, args []zoneToken, origin string) error {
+	texts := make([]string, len(args))
+	for i, t := range args {
+		texts[i] = t.text
+	}
+
+	need := func(n int) error {
+		if len(args) < n {
+			return fmt.Errorf("expected %d fields, got %d", n, len(args))
+		}
+		return nil
+	}
+
+	switch rec.Type {
+	case "SOA":
+		return nil
+	case "A", "AAAA":
+		if err := need(1); err != nil {
+			return err
+		}
+		rec.Content = texts[0]
+	case "CNAME", "NS", "PTR":
+		if err := need(1); err != nil {
+			return err
+		}
+		rec.Content = absName(texts[0], origin)
+	case "MX":
+		if err := need(2); err != nil {
+			return err
+		}
+		p, err := parseUint16(texts[0])
+		if err != nil {
+			return err
+		}
+		rec.Priority = &p
+		rec.Content = absName(texts[1], origin)
+	case "TXT":
+		if err := need(1); err != nil {
+			return err
+		}
+		rec.Content = strings.Join(texts, "")
+	case "SRV":
+		if err := need(4); err != nil {
+			return err
+		}
+		v := &CloudflareRecordData{Target: absName(texts[3], origin)}
+		var err error
+		if v.Priority, err = parseUint16(texts[0]); err != nil {
+			return err
+		}
+		if v.Weight, err = parseUint16(texts[1]); err != nil {
+			return err
+		}
+		if v.Port, err = parseUint16(texts[2]); err != nil {
+			return err
+		}
+		rec.Data = v
+	case "CAA":
+		if err := need(3); err != nil {
+			return err
+		}
+		flags, err := strconv.ParseUint(texts[0], 10, 8)
+		if err != nil {
+			return err
+		}
+		rec.Data = &CloudflareRecordData{Flags: uint8(flags), Tag: texts[1], Value: strings.Join(texts[2:], " ")}
+	case "HTTPS", "SVCB":
+		if err := need(2); err != nil {
+			return err
+		}
+		p, err := parseUint16(texts[0])
+		if err != nil {
+			return err
+		}
+		target := "."
+		if texts[1] != "." {
+			target = absName(texts[1], origin)
+		}
+		var params []string
+		for _, t := range args[2:] {
+			if t.quoted {
+				params = append(params, strconv.Quote(t.text))
+			} else {
+				params = append(params, t.text)
+			}
+		}
+		rec.Data = &CloudflareRecordData{Priority: p, Target: target, Value: strings.Join(params, " ")}
+	default:
+		rec.Content = strings.Join(texts, " ")
+	}
+	return nil
+}
+
+// recordRule returns the configured record which publishes the record.
+func recordRule(r CloudflareRecord) settings.Record {
+	rule := settings.Record{
+		Name:    r.Name,
+		Type:    r.Type,
+		Proxied: r.Proxied,
+		TTL:     r.TTL,
+		Content: r.Content,
+	}
+	if r.TTL == 1 {
+		rule.TTL = 0
+	}
+	if r.Priority != nil {
+		rule.Priority = *r.Priority
+	}
+	if r.Data != nil {
+		switch r.Type {
+		case "SRV":
+			rule.Priority, rule.Weight, rule.Port, rule.Target = r.Data.Priority, r.Data.Weight, r.Data.Port, r.Data.Target
+		case "CAA":
+			rule.Flags, rule.Tag, rule.Content = r.Data.Flags, r.Data.Tag, r.Data.Value
+		default:
+			rule.Priority, rule.Target, rule.Content = r.Data.Priority, r.Data.Target, r.Data.Value
+		}
+	}
+	return rule
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTXTStrings(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{`v=spf1 -all`, []string{"v=spf1 -all"}},
+		{`"v=spf1 -all"`, []string{"v=spf1 -all"}},
+		{`"v=DKIM1; k=rsa; " "p=MIIB"`, []string{"v=DKIM1; k=rsa; ", "p=MIIB"}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+		{`"a" b"`, []string{`a" b`}},
+	}
+	for _, tt := range tests {
+		if got := txtStrings(tt.content); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("txtStrings(%s) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestZoneRoundTrip(t *testing.T) {
+	priority := uint16(10)
+	records := []CloudflareRecord{
+		{Name: "example.com", Type: "A", Content: "192.0.2.1", TTL: 1, Proxied: true},
+		{Name: "www.example.com", Type: "AAAA", Content: "2001:db8::1", TTL: 300},
+		{Name: "alias.example.com", Type: "CNAME", Content: "www.example.com", TTL: 1},
+		{Name: "example.com", Type: "MX", Content: "mail.example.com", TTL: 3600, Priority: &priority},
+		{Name: "example.com", Type: "TXT", Content: `v=spf1 include:_spf.example.net -all`, TTL: 1},
+		{Name: "key._domainkey.example.com", Type: "TXT", Content: strings.Repeat("k", 300), TTL: 1},
+		{Name: "_sip._tcp.example.com", Type: "SRV", TTL: 1, Data: &CloudflareRecordData{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com"}},
+		{Name: "example.com", Type: "CAA", TTL: 1, Data: &CloudflareRecordData{Flags: 0, Tag: "issue", Value: "letsencrypt.org"}},
+		{Name: "example.com", Type: "HTTPS", TTL: 1, Data: &CloudflareRecordData{Priority: 1, Target: ".", Value: `alpn="h2,h3"`}},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteZone(buf, "example.com", records); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ParseZone(buf, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %d records, want %d:\n%s", len(got), len(records), buf)
+	}
+	for i := range records {
+		if !reflect.DeepEqual(got[i], records[i]) {
+			t.Errorf("record %d = %+v, want %+v", i, got[i], records[i])
+		}
+	}
+}
+
+func TestWriteZoneTXT(t *testing.T) {
+	buf := &bytes.Buffer{}
+	records := []CloudflareRecord{{Name: "example.com", Type: "TXT", Content: `"v=DKIM1; " "p=MIIB"`, TTL: 1}}
+	if err := WriteZone(buf, "example.com", records); err != nil {
+		t.Fatal(err)
+	}
+	if want := "example.com.\t1\tIN\tTXT\t\"v=DKIM1; \" \"p=MIIB\"\n"; !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("got:\n%s\nwant suffix:\n%s", buf, want)
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	data := `$ORIGIN example.com.
+$TTL 600
+@	IN	SOA	ns1.example.net. admin.example.com. (
+		2024010101 ; serial
+		7200 3600 1209600 300 )
+@		IN	A	192.0.2.1
+		IN	AAAA	2001:db8::1
+www	300	IN	CNAME	@
+`
+	got, err := ParseZone(strings.NewReader(data), "other.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CloudflareRecord{
+		{Name: "example.com", Type: "A", Content: "192.0.2.1", TTL: 600},
+		{Name: "example.com", Type: "AAAA", Content: "2001:db8::1", TTL: 600},
+		{Name: "www.example.com", Type: "CNAME", Content: "example.com", TTL: 300},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	_, err = ParseZone(strings.NewReader("@ IN A (192.0.2.1\n"), "example.com")
+	var e *SyntaxError
+	if !errors.As(err, &e) || e.Line != 2 {
+		t.Errorf("err = %v, want a syntax error at line 2", err)
+	}
+}
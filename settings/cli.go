@@ -19,6 +19,7 @@ var (
 	ErrHelp        = flag.ErrHelp
 	LogLevel       zapcore.Level
 	printVersion   bool
+	args           []string
 )
 
 func FlagParse() error {
@@ -51,6 +52,7 @@ func FlagParse() error {
 	if err := f.Parse(os.Args[1:]); err != nil {
 		return err
 	}
+	args = f.Args()
 
 	if printVersion {
 		fmt.Fprintln(os.Stdout, Version)
@@ -61,6 +63,11 @@ func FlagParse() error {
 	return nil
 }
 
+// Args returns the arguments after the flags, e.g. a command.
+func Args() []string {
+	return args
+}
+
 func structTag(f reflect.StructField, key string) (string, []string) {
 	s := strings.Split(f.Tag.Get(key), ",")
 	for i := range s {
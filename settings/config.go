@@ -1,11 +1,16 @@
 package settings
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+
+	"github.com/lightyen/cloudflare-ddns/zok"
 )
 
 const DefaultConfigPath = "config/config.json"
@@ -43,9 +48,9 @@ func readConfigFile(filename string) (config Settings, path string, err error) {
 			continue
 		}
 
-		buf := make([]byte, 4096)
-		n, err := f.Read(buf)
-		if err != nil && !errors.Is(err, io.EOF) {
+		buf, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
 			continue
 		}
 
@@ -53,7 +58,7 @@ func readConfigFile(filename string) (config Settings, path string, err error) {
 		case ".yml", ".yaml":
 			return config, "", errors.ErrUnsupported
 		case ".json":
-			if err := json.Unmarshal(buf[:n], &config); err != nil {
+			if err := json.Unmarshal(buf, &config); err != nil {
 				return config, target, err
 			}
 			return config, target, nil
@@ -63,3 +68,112 @@ func readConfigFile(filename string) (config Settings, path string, err error) {
 	err = os.ErrNotExist
 	return
 }
+
+// AddRecords appends the records to the config file, which is replaced atomically.
+// Only the records are rewritten, the other fields keep their order and formatting.
+func AddRecords(records ...Record) error {
+	filename := ConfigPath()
+
+	data, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	data, err = appendRecords(data, records)
+	if err != nil {
+		return err
+	}
+
+	return zok.WriteFile(filename, data, 0o644)
+}
+
+// appendRecords returns the config of which the records are appended with the others.
+func appendRecords(data []byte, records []Record) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte("{}\n")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, errors.New("config: not an object")
+	}
+
+	// the span of the value of the records, or the end of the last field
+	start, end := -1, -1
+	last := -1
+	indent := "  "
+	for dec.More() {
+		offset := int(dec.InputOffset())
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if last < 0 {
+			// the indent of the first field
+			key := offset + bytes.IndexByte(data[offset:], '"')
+			line := bytes.LastIndexByte(data[:key], '\n') + 1
+			if v := data[line:key]; len(bytes.TrimSpace(v)) > 0 {
+				indent = ""
+			} else if len(v) > 0 {
+				indent = string(v)
+			}
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		last = int(dec.InputOffset())
+		if t == "records" {
+			start, end = last-len(v), last
+		}
+	}
+
+	var items []json.RawMessage
+	if start >= 0 {
+		if err := json.Unmarshal(data[start:end], &items); err != nil {
+			return nil, fmt.Errorf("config: records: %w", err)
+		}
+	}
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, b)
+	}
+
+	var b []byte
+	var err error
+	if indent == "" {
+		b, err = json.Marshal(items)
+	} else {
+		b, err = json.MarshalIndent(items, indent, indent)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	switch {
+	case start >= 0:
+		buf.Write(data[:start])
+		buf.Write(b)
+		buf.Write(data[end:])
+	case last >= 0:
+		buf.Write(data[:last])
+		if indent == "" {
+			fmt.Fprintf(buf, `,"records":%s`, b)
+		} else {
+			fmt.Fprintf(buf, ",\n%s\"records\": %s", indent, b)
+		}
+		buf.Write(data[last:])
+	default:
+		i := bytes.IndexByte(data, '{') + 1
+		buf.Write(data[:i])
+		fmt.Fprintf(buf, "\n%s\"records\": %s\n", indent, b)
+		buf.Write(bytes.TrimLeft(data[i:], " \t\r\n"))
+	}
+	return buf.Bytes(), nil
+}
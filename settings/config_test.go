@@ -0,0 +1,46 @@
+package settings
+
+import "testing"
+
+func TestAppendRecords(t *testing.T) {
+	records := []Record{{Name: "b.example.com", Type: "A"}}
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "empty",
+			data: "",
+			want: "{\n  \"records\": [\n    {\n      \"name\": \"b.example.com\",\n      \"type\": \"A\",\n      \"proxied\": false\n    }\n  ]\n}\n",
+		},
+		{
+			name: "no records",
+			data: "{\n\t\"zone\": \"z\",\n\t\"email\": \"e\"\n}\n",
+			want: "{\n\t\"zone\": \"z\",\n\t\"email\": \"e\",\n\t\"records\": [\n\t\t{\n\t\t\t\"name\": \"b.example.com\",\n\t\t\t\"type\": \"A\",\n\t\t\t\"proxied\": false\n\t\t}\n\t]\n}\n",
+		},
+		{
+			name: "records",
+			data: "{\n  \"zone\": \"z\",\n  \"records\": [{\"name\": \"a.example.com\", \"type\": \"A\"}],\n  \"email\": \"e\"\n}\n",
+			want: "{\n  \"zone\": \"z\",\n  \"records\": [\n    {\n      \"name\": \"a.example.com\",\n      \"type\": \"A\"\n    },\n    {\n      \"name\": \"b.example.com\",\n      \"type\": \"A\",\n      \"proxied\": false\n    }\n  ],\n  \"email\": \"e\"\n}\n",
+		},
+		{
+			name: "compact",
+			data: `{"zone":"z"}`,
+			want: `{"zone":"z","records":[{"name":"b.example.com","type":"A","proxied":false}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := appendRecords([]byte(tt.data), records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
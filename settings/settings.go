@@ -2,6 +2,8 @@ package settings
 
 import (
 	"sync/atomic"
+
+	"github.com/lightyen/cloudflare-ddns/zok"
 )
 
 type Settings struct {
@@ -14,17 +16,274 @@ type Settings struct {
 	WebRoot       string `json:"www" yaml:"www"`
 	DataDirectory string `json:"data" yaml:"data"`
 
-	Email      string   `json:"email" yaml:"email"`
-	Token      string   `json:"token" yaml:"token"`
-	ZoneID     string   `json:"zone" yaml:"zone"`
-	Records    []Record `json:"records" yaml:"records" cli:",ignored"`
-	StaticIPv6 string   `json:"static_ipv6" yaml:"static_ipv6"`
+	ObserveOnly bool `json:"observe_only" yaml:"observe_only" usage:"observe the records without writing them"`
+
+	Email      string    `json:"email" yaml:"email"`
+	Token      string    `json:"token" yaml:"token"`
+	ZoneID     string    `json:"zone" yaml:"zone"`
+	Records    []Record  `json:"records" yaml:"records" cli:",ignored"`
+	StaticIPv6 string    `json:"static_ipv6" yaml:"static_ipv6"`
+	WANs       []WAN     `json:"wans" yaml:"wans" cli:",ignored"`
+	Detect     Detect    `json:"detect" yaml:"detect" cli:",ignored"`
+	Stability  Stability `json:"stability" yaml:"stability" cli:",ignored"`
+	Sync       Sync      `json:"sync" yaml:"sync" cli:",ignored"`
+	Snapshots  Snapshots `json:"snapshots" yaml:"snapshots" cli:",ignored"`
+	RFC2136    []RFC2136 `json:"rfc2136" yaml:"rfc2136" cli:",ignored"`
+	Responder  Responder `json:"responder" yaml:"responder" cli:",ignored"`
+	Leader     Leader    `json:"leader" yaml:"leader" cli:",ignored"`
+	Notify     Notify    `json:"notify" yaml:"notify" cli:",ignored"`
+
+	HealthChecks []HealthCheck `json:"health_checks" yaml:"health_checks" cli:",ignored"`
+	ReverseZones []ReverseZone `json:"reverse_zones" yaml:"reverse_zones" cli:",ignored"`
+	Lists        []List        `json:"lists" yaml:"lists" cli:",ignored"`
+}
+
+// WAN is an uplink of which the outbound discovery traffic is bound to an interface or a source address.
+type WAN struct {
+	Name       string `json:"name"`
+	Interface  string `json:"interface,omitempty"`
+	Address    string `json:"address,omitempty"`
+	Address6   string `json:"address6,omitempty"`
+	StaticIPv6 string `json:"static_ipv6,omitempty"`
+	// the router queried by upnp, natpmp and pcp, default to the gateway of the interface
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// Detect is the methods to detect the public addresses, which are queried in parallel and
+// the first successful one in order wins. The others are used as a second opinion.
+type Detect struct {
+	// http, stun, dns, upnp, natpmp, pcp (default: http)
+	IPv4 []string `json:"ipv4,omitempty"`
+	// outbound, http, stun, dns (default: outbound)
+	IPv6        []string `json:"ipv6,omitempty"`
+	STUNServers []string `json:"stun_servers,omitempty"`
+	// the query of dns: cloudflare, opendns, google (default: cloudflare)
+	DNSProvider string `json:"dns_provider,omitempty"`
+	// the resolver of dns, default to the one of the provider
+	DNSServer string `json:"dns_server,omitempty"`
+	// udp, tcp (default: udp)
+	DNSNetwork string `json:"dns_network,omitempty"`
+	// the router queried by upnp, natpmp and pcp, default to the gateway of the default route
+	Gateway string `json:"gateway,omitempty"`
+	// the addresses or prefixes accepted even if they are not routable on the Internet,
+	// e.g. private, CGNAT or documentation addresses
+	Allow []string `json:"allow,omitempty"`
+}
+
+// Stability is the condition that a changed address is published, either of the checks or the duration
+// is satisfied. It is published immediately if both are zero.
+type Stability struct {
+	// the number of consecutive checks that the address stays the same
+	Checks int `json:"checks,omitempty"`
+	// the duration that the address stays the same
+	Duration zok.Duration `json:"duration,omitempty"`
+}
+
+// Sync is the condition that the records are listed from Cloudflare. A run of which the desired
+// records are the same as the last applied ones only lists the records when the drift check interval
+// expires, and makes a full sync when the resync interval expires.
+type Sync struct {
+	// the interval of a forced full listing (default: 6h)
+	Resync zok.Duration `json:"resync,omitempty"`
+	// the interval of listing the records to detect a drift while the desired records are unchanged,
+	// a drift is detected at the resync only if negative (default: 15m)
+	DriftCheck zok.Duration `json:"drift_check,omitempty"`
+	// query the authoritative nameservers of the zone before a run is skipped,
+	// a mismatch makes a full listing
+	VerifyNameServers bool `json:"verify_nameservers,omitempty"`
+	// the timeout of waiting for the authoritative nameservers to serve an applied record (default: 2m)
+	PropagationTimeout zok.Duration `json:"propagation_timeout,omitempty"`
+}
+
+// Snapshots is the retention of the snapshots of the zone records, which are taken before every apply.
+type Snapshots struct {
+	// the maximum number of snapshots (default: 50)
+	Keep int `json:"keep,omitempty"`
+	// the maximum age of snapshots, unlimited if zero
+	MaxAge zok.Duration `json:"max_age,omitempty"`
+}
+
+// RFC2136 is a DNS server, e.g. BIND or Knot, which is updated with the records in its zone
+// by RFC 2136 dynamic updates.
+type RFC2136 struct {
+	Name string `json:"name,omitempty"`
+	// host:port
+	Server string `json:"server"`
+	Zone   string `json:"zone"`
+	// udp, tcp (default: udp)
+	Network string `json:"network,omitempty"`
+	// the ttl of a record of which the ttl is automatic (default: 300)
+	TTL      int    `json:"ttl,omitempty"`
+	TSIGName string `json:"tsig_name,omitempty"`
+	// hmac-md5, hmac-sha1, hmac-sha256, hmac-sha512 (default: hmac-sha256)
+	TSIGAlgorithm string `json:"tsig_algorithm,omitempty"`
+	// base64
+	TSIGSecret string `json:"tsig_secret,omitempty"`
+}
+
+// Responder is the embedded DNS server which answers authoritatively for the configured records.
+type Responder struct {
+	// the address listened on udp and tcp, e.g. ":53", disabled if empty
+	Listen string `json:"listen,omitempty"`
+	// (default: 60)
+	TTL int `json:"ttl,omitempty"`
+	// the networks of the clients answered with the LAN contents and the origins of the proxied records,
+	// default to the private, loopback, link-local and CGNAT addresses
+	LANNetworks []string `json:"lan_networks,omitempty"`
+	// the resolver to which the other queries of the clients in the LAN and the loopback are forwarded,
+	// refused if empty
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// Leader elects the only one of the instances which writes to the zone, the others are followers.
+type Leader struct {
+	// file: an advisory lock of the file on the shared storage,
+	// txt: a lease stored as a TXT record in the zone, disabled if empty
+	Method string `json:"method,omitempty"`
+	// file: the lock file
+	Lock string `json:"lock,omitempty"`
+	// txt: the name of the record, e.g. "_ddns-leader.example.com"
+	Name string `json:"name,omitempty"`
+	// txt: the duration of the lease, which is renewed every third of it (default: 1m)
+	TTL zok.Duration `json:"ttl,omitempty"`
+	// the identity of the instance (default: hostname-pid)
+	ID string `json:"id,omitempty"`
+}
+
+// Notify delivers the events, e.g. an address change, by the notifiers. The events are kept
+// in the outbox of the data directory until they are delivered.
+type Notify struct {
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	SMTP     SMTP      `json:"smtp"`
+	// the attempts of a delivery (default: 10)
+	Retries int `json:"retries,omitempty"`
+}
+
+// Webhook delivers the events by HTTP requests.
+type Webhook struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// (default: POST)
+	Method string `json:"method,omitempty"`
+	// the values are go templates of which the data is the event
+	Headers map[string]string `json:"headers,omitempty"`
+	// the payload shape: ntfy, gotify, slack, default to the event in json
+	Preset string `json:"preset,omitempty"`
+	// the go template of the body of which the data is the event, replaces the one of the preset
+	Body string `json:"body,omitempty"`
+	// the secret of the HMAC-SHA256 signature in the header X-Signature-256
+	Secret string `json:"secret,omitempty"`
+	// address, record.create, record.update, record.delete, failure, drift, digest (default: all but digest)
+	Events []string `json:"events,omitempty"`
+}
+
+// SMTP delivers the events by email, and the daily digest.
+type SMTP struct {
+	// disabled if empty
+	Host string `json:"host,omitempty"`
+	// (default: 587, 465 for tls)
+	Port int `json:"port,omitempty"`
+	// starttls, tls, none (default: starttls), none is not allowed with the username
+	Security string   `json:"security,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	// the immediate alerts (default: failure)
+	Events []string `json:"events,omitempty"`
+	// the local time of the daily digest, e.g. "08:00", disabled if empty
+	Digest string `json:"digest,omitempty"`
+}
+
+// ReverseZone is a delegated in-addr.arpa or ip6.arpa zone at Cloudflare.
+type ReverseZone struct {
+	// the zone id
+	Zone string `json:"zone"`
+	// the name of the zone, e.g. "0.8.b.d.0.1.0.0.2.ip6.arpa"
+	Name string `json:"name"`
+}
+
+// List is an IP List, an IP Access rule or a WAF custom rule at Cloudflare, of which the managed items are
+// replaced with the current addresses.
+type List struct {
+	// ip_list, access_rule, custom_rule
+	Type string `json:"type"`
+	// ip_list: the name of the list, access_rule: the label in the notes,
+	// custom_rule: the description of the rule, of which the addresses published in the set "ip.src in {...}"
+	// are replaced and the others are kept
+	Name string `json:"name"`
+	// ip_list: the account id
+	Account string `json:"account,omitempty"`
+	// access_rule: whitelist, block, challenge, js_challenge, managed_challenge (default: whitelist)
+	Mode string `json:"mode,omitempty"`
+	// the name of the WAN of which the addresses are published, default route if empty
+	WAN string `json:"wan,omitempty"`
+	// the addresses or the CIDRs of the items (default: {{.IPv4}})
+	Contents []string `json:"contents,omitempty"`
+}
+
+// HealthCheck probes a target on a schedule, a record which refers to it publishes
+// the failover contents while it is down.
+type HealthCheck struct {
+	Name string `json:"name"`
+	// tcp, http, udp
+	Type string `json:"type"`
+	// host:port, or the URL of http
+	Target string `json:"target"`
+	// the WAN through which the target is probed
+	WAN      string       `json:"wan,omitempty"`
+	Interval zok.Duration `json:"interval,omitempty"`
+	Timeout  zok.Duration `json:"timeout,omitempty"`
+	// consecutive failures before down
+	Fall int `json:"fall,omitempty"`
+	// consecutive successes before up
+	Rise int `json:"rise,omitempty"`
+	// the expected status code of http, any of 2xx and 3xx if zero
+	Status int `json:"status,omitempty"`
+	// the payload sent by udp
+	Send string `json:"send,omitempty"`
+	// the substring expected in the response of udp
+	Expect string `json:"expect,omitempty"`
 }
 
 type Record struct {
 	Name    string `json:"name"`
 	Type    string `json:"type"`
 	Proxied bool   `json:"proxied"`
+	TTL     int    `json:"ttl,omitempty"`
+	Content string `json:"content,omitempty"`
+	// the set of values of the record, each one is published as a separate record
+	Contents []string `json:"contents,omitempty"`
+
+	// MX, SRV, HTTPS
+	Priority uint16 `json:"priority,omitempty"`
+	// SRV
+	Weight uint16 `json:"weight,omitempty"`
+	Port   uint16 `json:"port,omitempty"`
+	// SRV, HTTPS
+	Target string `json:"target,omitempty"`
+	// CAA
+	Flags uint8  `json:"flags,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+
+	// the name of the WAN of which the addresses are published, default route if empty
+	WAN string `json:"wan,omitempty"`
+
+	// the name of the health check, the failover contents are published while it is down
+	HealthCheck string   `json:"health_check,omitempty"`
+	Failover    []string `json:"failover,omitempty"`
+
+	// A, AAAA: maintain the PTR records of the addresses in the reverse zones
+	PTR bool `json:"ptr,omitempty"`
+
+	// the maintenance group of which the proxied flag is switched together
+	Group string `json:"group,omitempty"`
+
+	// the contents answered by the embedded DNS responder to a client in the LAN
+	LAN []string `json:"lan,omitempty"`
+
+	// the policy of a change made outside, e.g. in the dashboard: correct, alert, adopt (default: correct)
+	Drift string `json:"drift,omitempty"`
 }
 
 var (
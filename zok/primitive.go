@@ -3,11 +3,13 @@ package zok
 import (
 	"encoding/json"
 	"strconv"
+	"time"
 )
 
 type Bool bool
 type Integer int
 type String string
+type Duration time.Duration
 
 func IsTrueValue(v string) bool {
 	return v == "1" || v == "yes" || v == "on" || v == "true" || v == "enabled"
@@ -115,3 +117,42 @@ func NewStringSlice(values []string) []String {
 	}
 	return s
 }
+
+func NewDuration(d time.Duration) *Duration {
+	ret := Duration(d)
+	return &ret
+}
+
+func (d Duration) Value() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *Duration) String() string {
+	if d == nil {
+		return "0s"
+	}
+	return d.Value().String()
+}
+
+// UnmarshalJSON accepts a duration string like "1m30s" or a number of seconds.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if v, err := strconv.Unquote(value); err == nil {
+		val, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(val)
+		return nil
+	}
+	val, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	*d = Duration(val * float64(time.Second))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Value().String())
+}